@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditMaxSize  = 10 // MB
+	defaultAuditMaxFiles = 10
+
+	auditFile = "audit.log"
+)
+
+// what the bot did, as recorded in the audit log
+const (
+	AuditDeletePost     = "delete_post"
+	AuditKeepPost       = "keep_post"
+	AuditWouldDelete    = "would_delete" // shadow mode
+	AuditGracePeriod    = "grace_period"
+	AuditMovePost       = "move_post"
+	AuditMarkPost       = "mark_post"
+	AuditSendDM         = "send_dm"
+	AuditAddMember      = "add_channel_member"
+	AuditRemoveMember   = "remove_channel_member"
+	AuditNotify         = "notify_stewards"
+	AuditMute           = "mute"
+	AuditUnmute         = "unmute"
+	AuditDeleteReaction = "delete_reaction"
+	AuditShadowMode     = "shadow_mode"
+	AuditOnboarding     = "onboarding" // what new members told us
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	At        time.Time
+	Actor     string // username of whoever made the bot do it, the bot itself for automatic actions
+	Action    string
+	PostId    string `json:",omitempty"`
+	UserId    string `json:",omitempty"` // the user acted on, e.g. the author of a deleted post
+	Username  string `json:",omitempty"`
+	ChannelId string `json:",omitempty"`
+	Channel   string `json:",omitempty"`
+	Rule      string `json:",omitempty"`
+	Detail    string `json:",omitempty"` // e.g. why a post broke the rule
+	Outcome   string // "ok", or what went wrong
+}
+
+// AuditQuery selects entries from the audit log. Empty fields match anything.
+type AuditQuery struct {
+	UserId    string
+	Username  string
+	ChannelId string
+	Action    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int // the most recent this many, 0 for all
+}
+
+// matches reports whether an entry is selected. A user matches entries about
+// them as well as the ones they made the bot do.
+func (q *AuditQuery) matches(e *AuditEntry) bool {
+	if q.UserId != "" || q.Username != "" {
+		if (q.UserId == "" || e.UserId != q.UserId) && !strings.EqualFold(e.Username, q.Username) && !strings.EqualFold(e.Actor, q.Username) {
+			return false
+		}
+	}
+	switch {
+	case q.ChannelId != "" && e.ChannelId != q.ChannelId:
+		return false
+	case q.Action != "" && e.Action != q.Action:
+		return false
+	case !q.Since.IsZero() && e.At.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.At.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only log of JSON lines in a directory. When the current
+// file grows past maxSize it is renamed with the time it was rotated, and only
+// the newest maxFiles rotated files are kept.
+type AuditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	lk   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenAuditLog opens (creating if needed) the audit log in dir
+func OpenAuditLog(dir string, maxSizeMB, maxFiles int) (*AuditLog, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultAuditMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultAuditMaxFiles
+	}
+	if err := os.MkdirAll(dir, os.FileMode(OS_USER_RWX)); err != nil {
+		return nil, err
+	}
+	l := &AuditLog{dir: dir, maxSize: int64(maxSizeMB) << 20, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending. The caller must hold l.lk.
+func (l *AuditLog) open() (err error) {
+	if l.file, err = os.OpenFile(filepath.Join(l.dir, auditFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	info, err := l.file.Stat()
+	if err != nil {
+		return
+	}
+	l.size = info.Size()
+	return
+}
+
+// rotate moves the current file aside and starts a new one. The caller must hold l.lk.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("audit-%s.log", time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(filepath.Join(l.dir, auditFile), filepath.Join(l.dir, rotated)); err != nil {
+		return err
+	}
+	files, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > l.maxFiles {
+		if err = os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return l.open()
+}
+
+// rotatedFiles returns the rotated files, oldest first
+func (l *AuditLog) rotatedFiles() (files []string, err error) {
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "audit-") && strings.HasSuffix(e.Name(), ".log") {
+			files = append(files, filepath.Join(l.dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return
+}
+
+// Append writes an entry to the log
+func (l *AuditLog) Append(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err = l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// Query returns the entries that match q, oldest first
+func (l *AuditLog) Query(q AuditQuery) (entries []AuditEntry, err error) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	files, err := l.rotatedFiles()
+	if err != nil {
+		return
+	}
+	for _, path := range append(files, filepath.Join(l.dir, auditFile)) {
+		if err = readAuditFile(path, &q, &entries); err != nil {
+			return
+		}
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+	return
+}
+
+func readAuditFile(path string, q *AuditQuery, entries *[]AuditEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e AuditEntry
+		// a line cut short by a crash shouldn't hide the rest
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if q.matches(&e) {
+			*entries = append(*entries, e)
+		}
+	}
+	return scanner.Err()
+}
+
+func (l *AuditLog) Close() error {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	return l.file.Close()
+}
+
+// AuditDir is where the audit log is kept, next to the bot's other state by default
+func (cfg *Config) AuditDir() string {
+	if cfg.AuditPath != "" {
+		return cfg.AuditPath
+	}
+	return filepath.Join(cfg.StateDir(), "audit")
+}
+
+// Audit records something the bot did. Automatic actions are done by the bot,
+// so Actor defaults to its username. Entries are written even for a handler
+// that's been cancelled, so the names aren't looked up with its context.
+func (b *Bot) Audit(e AuditEntry) {
+	if b.audit == nil {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	if e.Actor == "" {
+		e.Actor = b.cfg().UserName
+	}
+	if e.Outcome == "" {
+		e.Outcome = "ok"
+	}
+	// names are what people search for, and ids outlive them
+	if e.Username == "" && e.UserId != "" {
+		if user, resp := b.client.GetUser(e.UserId, ""); resp.Error == nil {
+			e.Username = user.Username
+		}
+	}
+	if e.Channel == "" && e.ChannelId != "" {
+		e.Channel = b.ChannelName(context.Background(), e.ChannelId)
+	}
+	if err := b.audit.Append(e); err != nil {
+		fmt.Printf("couldn't write to the audit log: %v\n", err)
+	}
+}
+
+// outcome describes how an API call went, for the audit log
+func outcome(err error) string {
+	if e, ok := err.(*model.AppError); ok && e == nil {
+		return "ok"
+	}
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return "ok"
+}
+
+// parseAuditTime reads --since and --until: a duration back from now like
+// "24h" or "7d", or a date like "2006-01-02"
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("`%s` isn't a time like `24h`, `7d` or `2006-01-02`", s)
+}
+
+// HandleAuditCommand shows what the bot did, most recent last
+func (b *Bot) HandleAuditCommand(inv *Invocation) error {
+	if b.audit == nil {
+		inv.Reply(inv.Phrase("audit-not-open", ""))
+		return nil
+	}
+	now := time.Now()
+	q := AuditQuery{Action: inv.Flag("action")}
+	if user := strings.TrimPrefix(inv.Flag("user"), "@"); user != "" {
+		q.Username = user
+		if u, resp := b.api(inv.Context()).GetUserByUsername(user, ""); resp.Error == nil {
+			q.UserId = u.Id
+		}
+	}
+	if ref := inv.Flag("channel"); ref != "" {
+		channel := b.FindChannelRef(inv.Context(), ref)
+		if channel == nil {
+			inv.Reply(inv.Phrase("channel-not-found", ref))
+			return nil
+		}
+		q.ChannelId = channel.Id
+	}
+	for flag, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := inv.Flag(flag); s != "" {
+			var err error
+			if *t, err = parseAuditTime(s, now); err != nil {
+				inv.Reply(inv.Phrase("audit-bad-time", s))
+				return nil
+			}
+		}
+	}
+	n, err := strconv.Atoi(inv.Flag("limit"))
+	if err != nil || n < 1 {
+		inv.Reply(inv.Phrase("audit-bad-limit", inv.Flag("limit")))
+		return nil
+	}
+	q.Limit = n
+
+	entries, err := b.audit.Query(q)
+	if err != nil {
+		inv.Reply(inv.Phrase("audit-unreadable", ""))
+		return err
+	}
+	if len(entries) == 0 {
+		inv.Reply(inv.Phrase("audit-nothing", ""))
+		return nil
+	}
+	text := inv.Say("audit-heading", func(d *MessageData) { d.Count = len(entries) }) + "\n" + inv.Phrase("audit-columns", "") +
+		"\n|---|---|---|---|---|---|---|---|\n"
+	for _, e := range entries {
+		user, channel := e.Username, e.Channel
+		if user != "" {
+			user = "@" + user
+		}
+		if channel != "" {
+			channel = "~" + channel
+		}
+		detail := strings.Replace(e.Detail, "\n", " ", -1)
+		if r := []rune(detail); len(r) > 60 {
+			detail = string(r[:60]) + "…"
+		}
+		text += fmt.Sprintf("| %s | @%s | %s | %s | %s | %s | %s | %s |\n", e.At.UTC().Format("Jan 2 15:04"), e.Actor, e.Action, user, channel, e.Rule,
+			strings.Replace(detail, "|", "\\|", -1), e.Outcome)
+	}
+	inv.Reply(text)
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"time"
+)
+
+// channels that opted in to automatic time conversion, by channel id
+const autoTimeNamespace = "autotime"
+
+const (
+	AutoTimeOff   = "off"
+	AutoTimeReply = "reply" // reply in the thread with the table
+	AutoTimeReact = "react" // add a reaction, clicking it DMs the table
+)
+
+const (
+	defaultAutoTimeEmoji    = "clock3"
+	defaultAutoTimeCooldown = 10 * time.Minute
+)
+
+// AutoTimeSetting is how a channel has opted in to automatic time conversion
+type AutoTimeSetting struct {
+	Mode      string
+	EnabledBy string // user id
+	EnabledAt int64  // millis
+}
+
+func (cfg *Config) autoTimeEmoji() string {
+	if cfg.AutoTimeEmoji != "" {
+		return strings.Trim(cfg.AutoTimeEmoji, ":")
+	}
+	return defaultAutoTimeEmoji
+}
+
+func (cfg *Config) autoTimeCooldown() (time.Duration, error) {
+	if cfg.AutoTimeCooldown == "" {
+		return defaultAutoTimeCooldown, nil
+	}
+	d, err := time.ParseDuration(cfg.AutoTimeCooldown)
+	if err != nil {
+		return 0, fmt.Errorf("isn't a duration like \"10m\": %v", err)
+	}
+	return d, nil
+}
+
+// AutoTimeMode returns the channel's automatic time conversion mode
+func (b *Bot) AutoTimeMode(channelId string) string {
+	var setting AutoTimeSetting
+	found, err := b.store.Get(autoTimeNamespace, channelId, &setting)
+	if err != nil {
+		fmt.Printf("error reading the auto time setting of %s: %v\n", channelId, err)
+	}
+	if !found || setting.Mode == "" {
+		return AutoTimeOff
+	}
+	return setting.Mode
+}
+
+// scheduledTimes are the times in a message that look like someone is
+// scheduling something: clock times with a zone, not "in 5 minutes"
+func (b *Bot) scheduledTimes(message string) (exprs []TimeExpr) {
+	for _, e := range ParseTimes(message, time.Now(), b.ResolveZone) {
+		if e.Err == nil && e.Zone != "" {
+			exprs = append(exprs, e)
+		}
+	}
+	return
+}
+
+// autoTimeAllowed reports whether the channel is out of its cooldown, and if it
+// is starts a new one
+func (b *Bot) autoTimeAllowed(channelId string) bool {
+	cooldown, _ := b.cfg().autoTimeCooldown()
+	b.autoTime.Lock()
+	defer b.autoTime.Unlock()
+	if b.autoTime.lastReply == nil {
+		b.autoTime.lastReply = make(map[string]time.Time)
+	}
+	if last, ok := b.autoTime.lastReply[channelId]; ok && time.Since(last) < cooldown {
+		return false
+	}
+	b.autoTime.lastReply[channelId] = time.Now()
+	return true
+}
+
+// HandleAutoTime converts the times in posts in channels that opted in, without
+// anyone having to ask with `@holobot time`
+func (b *Bot) HandleAutoTime(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	if post == nil || post.UserId == b.botUser.Id || post.Type != "" {
+		return
+	}
+	// asking explicitly is handled by the time command
+	if b.CommandLine(post.Message) != "" {
+		return
+	}
+	mode := b.AutoTimeMode(post.ChannelId)
+	if mode == AutoTimeOff {
+		return
+	}
+	exprs := b.scheduledTimes(post.Message)
+	if len(exprs) == 0 {
+		return
+	}
+
+	switch mode {
+	case AutoTimeReply:
+		if !b.autoTimeAllowed(post.ChannelId) {
+			return
+		}
+		zones, _ := b.TimeZonesFor(post.ChannelId, post.UserId)
+		heading := b.timeHeading(ctx, "")
+		var tables []string
+		for _, e := range exprs {
+			tables = append(tables, TimeTable(e, zones, time.Now(), "", heading))
+		}
+		b.SendMsgToChannel(ctx, post.ChannelId, strings.Join(tables, "\n\n"), threadRoot(post))
+	case AutoTimeReact:
+		reaction := &model.Reaction{UserId: b.botUser.Id, PostId: post.Id, EmojiName: b.cfg().autoTimeEmoji()}
+		if _, resp := b.api(ctx).SaveReaction(reaction); resp.Error != nil {
+			PrintError(resp.Error)
+			return resp.Error
+		}
+	}
+	return
+}
+
+// HandleAutoTimeReactions DMs the conversion table, in their own time zones, to
+// whoever clicks the reaction HandleAutoTime left on a post
+func (b *Bot) HandleAutoTimeReactions(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	reaction := model.ReactionFromJson(strings.NewReader(event.Data["reaction"].(string)))
+	if reaction == nil || reaction.UserId == b.botUser.Id || reaction.EmojiName != b.cfg().autoTimeEmoji() {
+		return
+	}
+	post, resp := b.api(ctx).GetPost(reaction.PostId, "")
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if b.AutoTimeMode(post.ChannelId) != AutoTimeReact {
+		return
+	}
+	exprs := b.scheduledTimes(post.Message)
+	if len(exprs) == 0 {
+		return
+	}
+
+	// clicking on and off again shouldn't fill up their DMs
+	key := post.Id + ":" + reaction.UserId
+	b.autoTime.Lock()
+	if b.autoTime.sent == nil || len(b.autoTime.sent) > 10000 {
+		b.autoTime.sent = make(map[string]bool)
+	}
+	sent := b.autoTime.sent[key]
+	b.autoTime.sent[key] = true
+	b.autoTime.Unlock()
+	if sent {
+		return
+	}
+
+	zones, _ := b.TimeZonesFor(post.ChannelId, reaction.UserId)
+	zones, highlight := b.personalTimeZones(ctx, reaction.UserId, zones)
+	msg := b.Say(ctx, reaction.UserId, "time-auto-times", func(d *MessageData) { d.Message = post.Message })
+	heading := b.timeHeading(ctx, reaction.UserId)
+	for _, e := range exprs {
+		msg += "\n\n" + TimeTable(e, zones, time.Now(), highlight, heading)
+	}
+	b.SendDirectMessage(ctx, reaction.UserId, msg)
+	return
+}
+
+// HandleTimeAutoCommand shows or changes the channel's automatic time conversion
+func (b *Bot) HandleTimeAutoCommand(inv *Invocation) error {
+	channelId := inv.Post.ChannelId
+	mode := strings.ToLower(inv.Arg("mode"))
+	switch mode {
+	case "":
+		switch b.AutoTimeMode(channelId) {
+		case AutoTimeReply:
+			inv.Reply(inv.Phrase("time-auto-reply-on", ""))
+		case AutoTimeReact:
+			inv.Reply(inv.Phrase("time-auto-react-on", b.cfg().autoTimeEmoji()))
+		default:
+			inv.Reply(inv.Phrase("time-auto-off", ""))
+		}
+		return nil
+	case AutoTimeOff:
+		if err := b.store.Delete(autoTimeNamespace, channelId); err != nil {
+			inv.Reply(inv.Phrase("not-saved", ""))
+			return err
+		}
+		inv.Reply(inv.Phrase("time-auto-turned-off", ""))
+		return nil
+	case AutoTimeReply, AutoTimeReact:
+	default:
+		inv.Reply(inv.Phrase("time-auto-unknown-mode", mode))
+		return nil
+	}
+
+	setting := AutoTimeSetting{Mode: mode, EnabledBy: inv.Post.UserId, EnabledAt: model.GetMillis()}
+	if err := b.store.Put(autoTimeNamespace, channelId, setting); err != nil {
+		inv.Reply(inv.Phrase("not-saved", ""))
+		return err
+	}
+	if mode == AutoTimeReply {
+		cooldown, _ := b.cfg().autoTimeCooldown()
+		inv.Reply(inv.Phrase("time-auto-turned-reply", cooldown.String()))
+	} else {
+		inv.Reply(inv.Phrase("time-auto-turned-react", b.cfg().autoTimeEmoji()))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"testing"
+)
+
+func TestHandleAutoTime(t *testing.T) {
+	tests := []struct {
+		mode      string
+		msgs      []string
+		replies   int
+		reactions int
+	}{
+		{AutoTimeOff, []string{"meeting at 3pm PT?"}, 0, 0},
+		{AutoTimeReply, []string{"meeting at 3pm PT?"}, 1, 0},
+		{AutoTimeReply, []string{"meeting at 3pm PT?", "or 4pm PT?"}, 1, 0}, // the cooldown
+		{AutoTimeReply, []string{"see you in 5 minutes"}, 0, 0},
+		{AutoTimeReact, []string{"meeting at 3pm PT?", "or 4pm PT?"}, 0, 2},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		if tt.mode != AutoTimeOff {
+			tb.store.Put(autoTimeNamespace, tb.town.Id, AutoTimeSetting{Mode: tt.mode})
+		}
+		for _, msg := range tt.msgs {
+			if err := tb.HandleAutoTime(context.Background(), tb.post(tb.alice, tb.town, msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(tb.s.Created) != tt.replies || len(tb.s.SavedReactions) != tt.reactions {
+			t.Errorf("%s %q: got %d replies and %d reactions, want %d and %d", tt.mode, tt.msgs,
+				len(tb.s.Created), len(tb.s.SavedReactions), tt.replies, tt.reactions)
+		}
+	}
+}
+
+func TestHandleAutoTimeReactions(t *testing.T) {
+	tb := newTestBot(t)
+	tb.store.Put(autoTimeNamespace, tb.town.Id, AutoTimeSetting{Mode: AutoTimeReact})
+	post := tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.town.Id, Message: "Tuesday 9-11am ET"})
+
+	bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+	reaction := &model.Reaction{UserId: bob.Id, PostId: post.Id, EmojiName: defaultAutoTimeEmoji}
+	for i := 0; i < 2; i++ {
+		if err := tb.HandleAutoTimeReactions(context.Background(), tb.s.ReactionEvent(reaction)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := tb.sentTo(tb.dm(bob), 0)
+	if len(got) != 1 || !strings.Contains(got[0], "> Tuesday 9-11am ET") || !strings.Contains(got[0], "| PT |") {
+		t.Errorf("bob got %q, want one table", got)
+	}
+
+	// other reactions don't ask for anything
+	tb.HandleAutoTimeReactions(context.Background(), tb.s.ReactionEvent(&model.Reaction{UserId: tb.alice.Id, PostId: post.Id, EmojiName: "thumbsup"}))
+	if got := tb.sentTo(tb.dm(tb.alice), 0); len(got) != 0 {
+		t.Errorf("alice got %q", got)
+	}
+}
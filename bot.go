@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/mattermost/mattermost-server/model"
+	"sync"
+	"time"
+)
+
+// Bot is one holobot connected to one Mattermost server. Each Bot owns its
+// config, API client, websocket and handler registries, so several can run
+// side by side in the same process.
+type Bot struct {
+	lk sync.RWMutex // guards config, actions, commands, moderation, messages and the debugging channel, which are swapped on reload
+
+	config          *Config
+	client          ChatClient
+	store           Store
+	audit           *AuditLog
+	catalog         *Catalog
+	webSocketClient *model.WebSocketClient
+
+	botUser                                *model.User
+	publicTeam, privateTeam, debuggingTeam *model.Team
+	debuggingChannel                       *model.Channel
+	townsquareChannel                      *model.Channel
+	announcementsChannel                   *model.Channel
+
+	actions    []Action
+	commands   []Command
+	dispatcher *Dispatcher
+
+	moderated         map[string][]ModerationRule // channel id -> the rules for it
+	moderatedChannels []*model.Channel
+
+	// lastSeen tracks the newest post we've received over the websocket so that
+	// after a reconnect we know where to start catching up from.
+	lastSeen struct {
+		sync.Mutex
+		at  int64           // CreateAt (millis) of the newest post seen
+		ids map[string]bool // ids of the posts created exactly at `at`
+		// ids of the posts the last catch-up replayed, which the websocket
+		// may deliver again as it was already listening
+		replayed map[string]bool
+	}
+
+	// autoTime rate limits automatic time conversion
+	autoTime struct {
+		sync.Mutex
+		lastReply map[string]time.Time // channel id -> when we last replied there
+		sent      map[string]bool      // "<post id>:<user id>" -> already DMed
+	}
+
+	// grace makes sure a post in its grace period is only dealt with once, by
+	// its author or by the timeout, whichever comes first
+	grace sync.Mutex
+	// discussions makes sure each post gets only one discussion thread
+	discussions sync.Mutex
+	// reloading makes sure only one reload of the config runs at a time
+	reloading sync.Mutex
+	// onboarding makes sure each step is only sent once
+	onboarding sync.Mutex
+	// welcoming makes sure nobody is welcomed to a team twice
+	welcoming sync.Mutex
+
+	cancel         context.CancelFunc
+	done           chan struct{}
+	stopSaving     chan bool
+	stopExpiring   chan bool
+	stopOnboarding chan bool
+	stopWatching   chan bool
+	watchInterval  time.Duration
+}
+
+// New creates a bot that talks to the Mattermost server named in cfg. Its
+// state is kept in cfg.StateDir, which is opened by Start.
+func New(cfg Config) *Bot {
+	// return NewWithClient(cfg, model.NewAPIv4Client("http://"+cfg.Domain), nil) //FOR TESTING
+	return NewWithClient(cfg, model.NewAPIv4Client("https://"+cfg.Domain), nil)
+}
+
+// NewWithClient creates a bot that uses the given client and store, e.g. the
+// tests' FakeServer and a MemStore. A nil store means a FileStore in cfg.StateDir.
+func NewWithClient(cfg Config, client ChatClient, store Store) *Bot {
+	return &Bot{config: &cfg, client: client, store: store}
+}
+
+// Start logs in, finds the teams and channels the bot works with, and starts
+// listening on the websocket. It returns once the bot is up; the bot keeps
+// running until ctx is cancelled or Stop is called.
+func (b *Bot) Start(ctx context.Context) (err error) {
+	if b.cancel != nil {
+		return errors.New("bot already started")
+	}
+
+	if b.store == nil {
+		if b.store, err = NewFileStore(b.cfg().StateDir()); err != nil {
+			return
+		}
+	}
+
+	if b.audit == nil {
+		if b.audit, err = OpenAuditLog(b.cfg().AuditDir(), b.cfg().AuditMaxSize, b.cfg().AuditMaxFiles); err != nil {
+			return
+		}
+	}
+
+	// better to find out about broken messages now than when someone joins
+	if err = b.reloadMessages(); err != nil {
+		return
+	}
+
+	// Let's test to see if the mattermost server is up and running
+	if err = b.MakeSureServerIsRunning(); err != nil {
+		return
+	}
+
+	// let's attempt to login to the Mattermost server as the bot user
+	// This will set the token required for all future calls
+	if err = b.LoginAsTheBotUser(); err != nil {
+		return
+	}
+
+	// If the bot user doesn't have the correct information let's update its profile
+	if err = b.UpdateTheBotUserIfNeeded(); err != nil {
+		return
+	}
+
+	// Let's find our teams
+	if b.publicTeam, err = b.FindTeam(ctx, b.cfg().PublicTeamName); err != nil {
+		return
+	}
+	if b.privateTeam, err = b.FindTeam(ctx, b.cfg().PrivateTeamName); err != nil {
+		return
+	}
+	if b.debuggingTeam, err = b.FindTeam(ctx, b.cfg().DebuggingTeamName); err != nil {
+		return
+	}
+
+	b.announcementsChannel = b.FindChannel(ctx, "announcements", b.publicTeam)
+	if b.announcementsChannel == nil {
+		return errors.New("couldn't find the announcements channel")
+	}
+
+	b.registerActions()
+	b.registerCommands()
+	b.registerModeration(ctx)
+	b.checkMessages()
+
+	if b.cfg().Debugging {
+		println("DEGUBBING IS ON, BOIS")
+		// Let's create a bot channel for logging debug messages into
+		b.CreateBotDebuggingChannelIfNeeded(ctx)
+		b.SendMsgToDebuggingChannel("_"+b.cfg().LongName+" has **started** running_", "")
+	}
+
+	timeout, _ := b.cfg().handlerTimeout()
+	b.dispatcher = NewDispatcher(b, b.cfg().Workers, b.cfg().QueueSize, timeout)
+
+	ctx, b.cancel = context.WithCancel(ctx)
+	b.done = make(chan struct{})
+	b.stopSaving = Ticker(time.Minute, b.saveLastSeen)
+	b.stopExpiring = Ticker(graceCheckInterval, func() {
+		b.ExpireGracePeriods(ctx)
+		b.RestoreMutes(ctx)
+	})
+	b.stopOnboarding = Ticker(onboardingCheckInterval, func() {
+		b.WelcomePending(ctx)
+		b.AdvanceOnboarding(ctx)
+	})
+	b.watchConfig()
+
+	// Let's start listening to some channels via the websocket! The supervisor
+	// reconnects whenever the connection drops.
+	go func() {
+		b.SuperviseWebSocket(ctx)
+		close(b.done)
+	}()
+	return
+}
+
+// Stop disconnects the bot and waits for its websocket supervisor to exit
+func (b *Bot) Stop() {
+	if b.cancel == nil {
+		return
+	}
+	b.lk.Lock()
+	if b.stopWatching != nil {
+		b.stopWatching <- true
+		b.stopWatching = nil
+	}
+	b.lk.Unlock()
+	b.cancel()
+	<-b.done
+	b.dispatcher.Stop()
+	b.stopSaving <- true
+	b.stopExpiring <- true
+	b.stopOnboarding <- true
+	b.saveLastSeen()
+	b.audit.Close()
+	b.SendMsgToDebuggingChannel("_"+b.cfg().LongName+" has **stopped** running_", "")
+}
+
+func (b *Bot) registerActions() {
+	//array of all the actions
+	actions := []Action{
+		Action{Name: "Command Handler", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleCommands},
+		Action{Name: "About DM Response", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleDMs},
+		Action{Name: "Moderation", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleModeration},
+		Action{Name: "Grace Period Replies", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleGraceReplies},
+		Action{Name: "Onboarding Replies", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleOnboardingReplies},
+		Action{Name: "Welcome New Users", Event: model.WEBSOCKET_EVENT_NEW_USER, Handler: b.HandleTeamJoins},
+		Action{Name: "Welcome To Team", Event: model.WEBSOCKET_EVENT_USER_ADDED, Handler: b.HandleTeamJoins},
+		Action{Name: "Welcome To Team Directly", Event: model.WEBSOCKET_EVENT_ADDED_TO_TEAM, Handler: b.HandleTeamJoins},
+		Action{Name: "Delete Own Message", Event: model.WEBSOCKET_EVENT_REACTION_ADDED, Handler: b.HandleReactions},
+		Action{Name: "Source Requests", Event: model.WEBSOCKET_EVENT_REACTION_ADDED, Handler: b.HandleSourceRequests},
+		Action{Name: "Auto Time", Event: model.WEBSOCKET_EVENT_POSTED, Handler: b.HandleAutoTime},
+		Action{Name: "Auto Time DMs", Event: model.WEBSOCKET_EVENT_REACTION_ADDED, Handler: b.HandleAutoTimeReactions},
+	}
+	// if debug mode is on, activate the Debug Log Channel Handler
+	if b.cfg().Debugging {
+		actions = append(actions, Action{Name: "Debug Log Channel Handler",
+			Event:   model.WEBSOCKET_EVENT_POSTED,
+			Handler: b.HandleMsgFromDebuggingChannel})
+		actions = append(actions, Action{Name: "HandleShowAllChannelEvents",
+			Handler: b.HandleShowAllChannelEvents})
+	}
+
+	b.lk.Lock()
+	b.actions = actions
+	b.lk.Unlock()
+}
+
+func (b *Bot) registerCommands() {
+	commands := []Command{
+		Command{
+			Name:        "help",
+			Description: "I'll tell you what I can do, or explain one of my commands in detail.",
+			Examples:    []string{"@holobot help time"},
+			Replies:     ReplyPrivate,
+			Args:        []Arg{Arg{Name: "command", Variadic: true}},
+			Handler:     b.HandleHelpCommand,
+		},
+
+		Command{
+			Name:        "stats",
+			Description: "Shows how busy my event queues are and how my actions are doing.",
+			Category:    "Admin",
+			Visibility:  VisibilityAdmin,
+			Replies:     ReplyPrivate,
+			Handler: func(inv *Invocation) error {
+				inv.Reply(b.dispatcher.Stats())
+				return nil
+			},
+		},
+
+		Command{
+			Name:        "moderation",
+			Description: "Shows which moderation rules are enforced, tries out rules in shadow mode before enforcing them, and keeps track of repeat offenders.",
+			Category:    "Admin",
+			Visibility:  VisibilityAdmin,
+			Replies:     ReplyPrivate,
+			Subcommands: []Command{
+				Command{
+					Name:        "shadow",
+					Description: "Shows the rules of a moderated channel, or turns shadow mode `on` or `off` for it. In shadow mode I only record what I would delete.",
+					Examples:    []string{"@holobot moderation shadow on --channel my-team/announcements"},
+					Args:        []Arg{Arg{Name: "mode"}},
+					Flags:       []Flag{Flag{Name: "channel", Description: "the channel, as team-name/channel-name, if not this one"}},
+					Handler:     b.HandleShadowCommand,
+				},
+				Command{
+					Name:        "offenders",
+					Description: "Lists whose posts I deleted most lately, and who can't post in a channel for now.",
+					Handler:     b.HandleOffendersCommand,
+				},
+				Command{
+					Name:        "forgive",
+					Description: "Forgets the posts I deleted of someone, and adds them back to any channel I took them out of.",
+					Examples:    []string{"@holobot moderation forgive @alice"},
+					Args:        []Arg{Arg{Name: "user", Required: true}},
+					Handler:     b.HandleForgiveCommand,
+				},
+				Command{
+					Name:        "report",
+					Description: "Summarises what shadow mode would have deleted in the last few days.",
+					Examples:    []string{"@holobot moderation report 30"},
+					Args:        []Arg{Arg{Name: "days"}},
+					Handler:     b.HandleShadowReportCommand,
+				},
+			},
+		},
+
+		Command{
+			Name:        "audit",
+			Description: "Shows what I did: deleted, moved or marked posts, DMs, channel additions and so on. Filter by user, channel, action or time.",
+			Examples:    []string{"@holobot audit --user @alice --since 7d", "@holobot audit --channel announcements --action delete_post"},
+			Category:    "Admin",
+			Visibility:  VisibilityAdmin,
+			Replies:     ReplyPrivate,
+			Flags: []Flag{
+				Flag{Name: "user", Description: "only what concerns this user, or what they had me do"},
+				Flag{Name: "channel", Description: "only what happened in this channel, as team-name/channel-name"},
+				Flag{Name: "action", Description: "only this action, e.g. `delete_post`, `move_post` or `add_channel_member`"},
+				Flag{Name: "since", Description: "from this long ago (`24h`, `7d`) or this date (`2006-01-02`, UTC)"},
+				Flag{Name: "until", Description: "up to this long ago or this date"},
+				Flag{Name: "limit", Description: "how many of the most recent entries to show", Default: "20"},
+			},
+			Handler: b.HandleAuditCommand,
+		},
+
+		Command{
+			Name:        "preview",
+			Description: "Shows one of my messages as it would be sent, or lists them all. They're templates in my messages directory, reloaded with the config.",
+			Examples:    []string{"@holobot preview welcome", "@holobot preview help-outro --as @alice", "@holobot preview tips --locale es"},
+			Category:    "Admin",
+			Visibility:  VisibilityAdmin,
+			Replies:     ReplyPrivate,
+			Args:        []Arg{Arg{Name: "template"}},
+			Flags: []Flag{
+				Flag{Name: "as", Description: "render it for this user instead of you"},
+				Flag{Name: "locale", Description: "render it in this locale, e.g. `es`, instead of theirs"},
+			},
+			Handler: b.HandlePreviewCommand,
+		},
+
+		// time command
+		Command{
+			Name:        "time",
+			Description: "I'll reply with a handy table translating the times you mentioned in your message into various relevant time zones.",
+			Usage:       "@" + b.cfg().UserName + " time",
+			Examples:    []string{"Does a meeting at 9 AM EST work for everyone? @holobot time"},
+			Args:        []Arg{Arg{Name: "text", Variadic: true}},
+			Handler:     b.HandleTimeCommand,
+			Subcommands: []Command{
+				Command{
+					Name:        "for",
+					Description: "Converts the times in your message into the time zones the people you mention have in their profiles.",
+					Examples:    []string{"Can we meet Tuesday at 3pm PT? @holobot time for @alice @bob"},
+					Args:        []Arg{Arg{Name: "users", Required: true, Variadic: true}},
+					Handler:     b.HandleTimeForCommand,
+				},
+				Command{
+					Name:        "auto",
+					Description: "Shows or changes whether I convert times here without being asked: `reply` with a table, `react` so people can ask for it by DM, or `off`.",
+					Examples:    []string{"@holobot time auto react"},
+					Args:        []Arg{Arg{Name: "mode"}},
+					Handler:     b.HandleTimeAutoCommand,
+				},
+				Command{
+					Name:        "zones",
+					Description: "Lists the time zones I show here. Channels and people can have their own.",
+					Examples:    []string{"@holobot time zones add Asia/Tokyo", "@holobot time zones add Europe/Berlin --me --24h"},
+					Flags:       timeZoneFlags[:1],
+					Handler:     b.HandleTimeZonesList,
+					Subcommands: []Command{
+						Command{
+							Name:        "add",
+							Description: "Adds a time zone, by name (`Asia/Tokyo`) or abbreviation, to this channel's list.",
+							Args:        []Arg{Arg{Name: "zone", Required: true}, Arg{Name: "label"}},
+							Flags:       timeZoneFlags,
+							Handler:     b.HandleTimeZonesAdd,
+						},
+						Command{
+							Name:        "remove",
+							Description: "Removes a time zone, by label or name, from this channel's list.",
+							Args:        []Arg{Arg{Name: "zone", Required: true}},
+							Flags:       timeZoneFlags[:1],
+							Handler:     b.HandleTimeZonesRemove,
+						},
+						Command{
+							Name:        "reset",
+							Description: "Goes back to the default time zones.",
+							Flags:       timeZoneFlags[:1],
+							Handler:     b.HandleTimeZonesReset,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	b.lk.Lock()
+	b.commands = commands
+	b.lk.Unlock()
+}
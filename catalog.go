@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// the templates holobot can't do without, by name (their file name without the
+// extension, or their key in a strings file)
+var requiredMessages = []string{"welcome", "help-intro", "help-outro", "tips", "post-deleted", "post-deleted-reminder",
+	"time-not-understood", "time-minutes", "time-hours-24", "time-hours-12", "time-unknown-date", "time-not-a-date",
+	"time-offset", "time-no-zone", "time-unknown-user", "time-unknown-zone", "time-zone-not-listed", "time-last-zone", "not-saved",
+	"onboarding-interests-noted", "onboarding-joined", "onboarding-nothing-to-join", "onboarding-feedback",
+	"onboarding-feedback-noted", "onboarding-stopped", "reason-not-an-announcement", "reason-pattern", "reason-too-long", "reason-file-type",
+	"reply-moved", "discussion-started", "reply-relocated", "post-moved", "attachments-not-moved",
+	"grace-period", "grace-fixed", "grace-expired", "grace-not-holding", "grace-gone", "grace-rule-gone", "grace-deleted",
+	"grace-failed", "grace-moved", "grace-cant-mark", "grace-mark-wont-help", "grace-marked",
+	"repeat-offender", "repeat-offender-muted", "muted", "unmuted", "offenders-unreadable", "offenders-none",
+	"offenders-columns", "offenders-muted", "offenders-muted-until", "unknown-user", "forgiven",
+	"time-heading", "time-you", "time-now", "time-zones-user", "time-zones-channel", "time-zones-config", "time-clock-12",
+	"time-clock-24", "time-zone-already-listed", "time-zone-added", "time-zone-removed", "time-zones-reset",
+	"time-auto-reply-on", "time-auto-react-on", "time-auto-off", "time-auto-turned-off", "time-auto-turned-reply",
+	"time-auto-turned-react", "time-auto-unknown-mode", "time-auto-times",
+	"channel-not-found", "shadow-not-moderated", "shadow-modes", "shadow-rules", "shadow-rule-shadow", "shadow-rule-enforced",
+	"shadow-bad-days", "shadow-unreadable", "shadow-report-none", "shadow-report-heading", "shadow-report-columns",
+	"shadow-report-authors", "shadow-report-recent", "shadow-report-post",
+	"audit-not-open", "audit-bad-time", "audit-bad-limit", "audit-unreadable", "audit-nothing", "audit-heading", "audit-columns",
+	"source", "command-unterminated-quote", "command-missing-subcommand", "command-unknown-subcommand", "command-unknown-flag",
+	"command-flag-needs-value", "command-missing-argument", "command-unexpected-argument", "command-unknown", "command-see-help",
+	"command-usage", "command-flag-default", "help-columns", "help-reply-flags", "help-examples"}
+
+// template files are markdown, but any of these will do
+var messageExtensions = []string{".md", ".txt", ".tmpl"}
+
+const defaultLocale = "en"
+
+// messageFuncs are available in every template, including the ones in ModerationRules
+var messageFuncs = template.FuncMap{
+	"join": strings.Join,
+	// mentions turns usernames into "@alice, @bob"
+	"mentions": func(names []string) string {
+		var out []string
+		for _, name := range names {
+			out = append(out, "@"+strings.TrimPrefix(name, "@"))
+		}
+		return strings.Join(out, ", ")
+	},
+	// channels turns channel names into "~general, ~random"
+	"channels": func(names []string) string {
+		var out []string
+		for _, name := range names {
+			out = append(out, "~"+name)
+		}
+		return strings.Join(out, ", ")
+	},
+	// blockquote quotes a message line by line
+	"blockquote": func(msg string) string {
+		return "> " + strings.Replace(msg, "\n", "\n> ", -1)
+	},
+}
+
+// MessageData is what the templates get. The post fields are only filled in
+// for messages about a post that broke a moderation rule.
+type MessageData struct {
+	User    string   // username of who the message is for
+	Locale  string   // their locale, e.g. "en" or "pt-BR", "" for the default
+	Bot     string   // the bot's username
+	BotName string   // the bot's LongName
+	Team    string   // the public team's name, or the team of the post
+	Admins  []string // the configured Admins
+
+	Channel, Rule, Reason, Message string
+	Quoted                         string // the message indented as a code block
+	Count                          int    // how many of their posts were deleted lately
+
+	Value string // what a short message is about, e.g. the date that wasn't understood
+
+	Author string // who wrote the post it's about, when that isn't User
+	Link   string // a link to the post it's about
+	Target string // the channel the post was or can be moved to
+	PostId string // the start of the post's id, which people can reply with
+	Tag    string // what marks a post as following the rule, e.g. "#announcement"
+	Reply  bool   // whether the post is a reply
+
+	Guess string // what they probably meant, e.g. the command a typo is closest to
+
+	Zone string // a time zone, e.g. "Asia/Tokyo"
+	Own  bool   // whether it's about the user's own time zones rather than the channel's
+
+	Interests []string // what a new member said they're interested in
+	Joined    []string // the channels they asked to join and were added to
+	NotFound  []string // the ones they couldn't be added to
+
+	channels    func() []string
+	suggestions func() []string
+}
+
+// Channels lists the public channels of the team by name. They're only looked
+// up if a template uses them.
+func (d *MessageData) Channels() []string {
+	if d.channels == nil {
+		return nil
+	}
+	return d.channels()
+}
+
+// Suggestions lists the public channels that match a new member's interests,
+// which are only looked up if a template uses them
+func (d *MessageData) Suggestions() []string {
+	if d.suggestions == nil {
+		return nil
+	}
+	return d.suggestions()
+}
+
+// Catalog is the set of message templates loaded from a directory, with a
+// subdirectory for each locale, e.g. messages/en and messages/pt-BR
+type Catalog struct {
+	dir           string
+	defaultLocale string
+	locales       map[string]*template.Template // normalized locale -> its templates
+	loaded        time.Time
+}
+
+// LoadCatalog parses the templates of every locale in dir. It fails if one
+// doesn't parse or can't be rendered, if a required one is missing from the
+// default locale, or if a locale doesn't have exactly the default's messages:
+// a partly translated catalog would greet people in two languages.
+func LoadCatalog(dir, defaultLocale string) (*Catalog, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the messages in %s: %v", dir, err)
+	}
+	c := &Catalog{dir: dir, defaultLocale: normalizeLocale(defaultLocale), locales: make(map[string]*template.Template), loaded: time.Now()}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if c.locales[normalizeLocale(e.Name())], err = loadLocale(filepath.Join(dir, e.Name())); err != nil {
+			return nil, err
+		}
+	}
+	def := c.locales[c.defaultLocale]
+	if def == nil {
+		return nil, fmt.Errorf("%s has no messages for the default locale %q", dir, defaultLocale)
+	}
+
+	var problems []string
+	if missing := missingMessages(requiredMessages, def); len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("%s is missing %s", defaultLocale, strings.Join(missing, ", ")))
+	}
+	for _, locale := range c.Locales() {
+		t := c.locales[locale]
+		if t == def {
+			continue
+		}
+		if missing := missingMessages(templateNames(def), t); len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s is missing %s", locale, strings.Join(missing, ", ")))
+		}
+		if extra := missingMessages(templateNames(t), def); len(extra) > 0 {
+			problems = append(problems, fmt.Sprintf("%s has %s, which %s doesn't", locale, strings.Join(extra, ", "), defaultLocale))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("the messages in %s don't add up: %s", dir, strings.Join(problems, "; "))
+	}
+
+	// catch templates that parse but use fields that don't exist
+	sample := sampleMessageData()
+	for _, locale := range c.Locales() {
+		sample.Locale = locale
+		for _, name := range c.Names() {
+			if _, err = c.Render(name, sample); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// loadLocale parses the template files in a locale's directory. Short
+// messages can also go in a strings file (strings.yaml, .json or .toml)
+// mapping names to templates.
+func loadLocale(dir string) (*template.Template, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	templates := template.New("").Funcs(messageFuncs)
+	add := func(name, text, file string) error {
+		if templates.Lookup(name) != nil {
+			return fmt.Errorf("%s: there's more than one message called %q", file, name)
+		}
+		// editors like to end files with a newline, messages shouldn't
+		_, err := templates.New(name).Parse(strings.TrimRight(text, "\n"))
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if format := EncodingFormat(e.Name()); format != "" {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			strs := make(map[string]string)
+			err = Decode(f, format, &strs)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			for name, text := range strs {
+				if err = add(name, text, path); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		name, ext := messageName(e.Name())
+		if ext == "" {
+			continue
+		}
+		text, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = add(name, string(text), path); err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+// messageName splits a file name into the name of its template and its
+// extension, which is "" if it isn't a template file
+func messageName(file string) (name, ext string) {
+	ext = strings.ToLower(filepath.Ext(file))
+	for _, e := range messageExtensions {
+		if ext == e && !strings.HasPrefix(file, ".") {
+			return strings.TrimSuffix(file, filepath.Ext(file)), ext
+		}
+	}
+	return file, ""
+}
+
+// normalizeLocale makes "pt_BR" and "pt-br" the same locale
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+func templateNames(t *template.Template) (names []string) {
+	for _, t := range t.Templates() {
+		if t.Name() != "" {
+			names = append(names, t.Name())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// missingMessages returns the names that t doesn't have
+func missingMessages(names []string, t *template.Template) (missing []string) {
+	for _, name := range names {
+		if t.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	return
+}
+
+// Has reports whether the catalog has a message called name
+func (c *Catalog) Has(name string) bool {
+	return name != "" && c.locales[c.defaultLocale].Lookup(name) != nil
+}
+
+// Names returns the names of the messages, sorted
+func (c *Catalog) Names() []string {
+	return templateNames(c.locales[c.defaultLocale])
+}
+
+// Locales returns the locales the catalog has messages for, sorted
+func (c *Catalog) Locales() (locales []string) {
+	for locale := range c.locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return
+}
+
+// Locale returns the locale the catalog speaks to someone in locale: the same
+// one, the same language ("pt" for "pt-BR") or else the default
+func (c *Catalog) Locale(locale string) string {
+	locale = normalizeLocale(locale)
+	if c.locales[locale] != nil {
+		return locale
+	}
+	if i := strings.Index(locale, "-"); i > 0 && c.locales[locale[:i]] != nil {
+		return locale[:i]
+	}
+	return c.defaultLocale
+}
+
+// Render executes the message called name in data's locale
+func (c *Catalog) Render(name string, data *MessageData) (string, error) {
+	if !c.Has(name) {
+		return "", fmt.Errorf("there's no message called %q in %s", name, c.dir)
+	}
+	var buf bytes.Buffer
+	if err := c.locales[c.Locale(data.Locale)].ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sampleMessageData is what templates are tried out and previewed with
+func sampleMessageData() *MessageData {
+	msg := "Anyone up for lunch?\nI'm buying!"
+	return &MessageData{User: "alice", Bot: "holobot", BotName: "Holobot", Team: "my-team", Admins: []string{"will"},
+		Channel: "announcements", Rule: "announcements", Reason: "it isn't an announcement", Message: msg,
+		Quoted: quote(msg), Count: 1, Value: "Tuesday", Author: "bob", Link: "https://chat.example.com/my-team/pl/1234567890",
+		Target: "town-square", PostId: "123456", Tag: "#announcement", Reply: true, Guess: "time", Zone: "Asia/Tokyo", Own: true,
+		Interests: []string{"hosting", "app development"}, Joined: []string{"app-dev"}, NotFound: []string{"rust"},
+		channels:    func() []string { return []string{"announcements", "town-square"} },
+		suggestions: func() []string { return []string{"holoport-host-qa", "app-dev"} }}
+}
+
+// quote indents a message as a code block
+func quote(msg string) string {
+	return "    " + strings.Replace(msg, "\n", "\n    ", -1)
+}
+
+// MessagesDir is where the message templates are kept
+func (cfg *Config) MessagesDir() string {
+	if cfg.MessagesPath != "" {
+		return cfg.MessagesPath
+	}
+	return "messages"
+}
+
+// messagesModified returns when the newest file or locale directory in dir was
+// changed. Removing a file only changes its directory.
+func messagesModified(dir string) (last time.Time) {
+	if info, err := os.Stat(dir); err == nil {
+		last = info.ModTime()
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if e.ModTime().After(last) {
+			last = e.ModTime()
+		}
+		files, _ := ioutil.ReadDir(filepath.Join(dir, e.Name()))
+		for _, f := range files {
+			if f.ModTime().After(last) {
+				last = f.ModTime()
+			}
+		}
+	}
+	return
+}
+
+// Locale is who the messages are for when a user's own locale isn't in the catalog
+func (cfg *Config) Locale() string {
+	if cfg.DefaultLocale != "" {
+		return cfg.DefaultLocale
+	}
+	return defaultLocale
+}
+
+// reloadMessages swaps in the templates from the configured directory. If
+// they can't be loaded the old ones are kept.
+func (b *Bot) reloadMessages() error {
+	c, err := LoadCatalog(b.cfg().MessagesDir(), b.cfg().Locale())
+	if err != nil {
+		fmt.Printf("couldn't load the messages, keeping the old ones: %v\n", err)
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("**Couldn't load the messages, keeping the old ones:**\n```\n%v\n```", err), "")
+		return err
+	}
+	b.lk.Lock()
+	b.catalog = c
+	b.lk.Unlock()
+	return nil
+}
+
+// checkMessages reports the messages the config uses that aren't in the catalog.
+// A rule whose message is missing still deletes posts, the authors just aren't
+// told why, and onboarding steps that are missing are skipped.
+func (b *Bot) checkMessages() {
+	c, err := b.messages()
+	if err != nil {
+		return
+	}
+	var missing []string
+	for _, rule := range b.cfg().moderationRules() {
+		if rule.Template != "" && !c.Has(rule.Template) {
+			missing = append(missing, fmt.Sprintf("%s (rule %s)", rule.Template, rule.Name))
+		}
+	}
+	for _, step := range b.cfg().onboardingSteps() {
+		if !c.Has(step.Message) {
+			missing = append(missing, fmt.Sprintf("%s (onboarding)", step.Message))
+		}
+	}
+	for _, w := range b.cfg().teamWelcomes() {
+		if w.Message != "" && !c.Has(w.Message) {
+			missing = append(missing, fmt.Sprintf("%s (welcome to %s)", w.Message, w.Team))
+		}
+	}
+	if len(missing) > 0 {
+		msg := fmt.Sprintf("the config uses messages that aren't in %s: %s", c.dir, strings.Join(missing, ", "))
+		fmt.Println(msg)
+		b.SendMsgToDebuggingChannel("**"+msg+"**", "")
+	}
+}
+
+// messages returns the current templates, loading them if that hasn't happened
+// yet (e.g. for a bot that wasn't started)
+func (b *Bot) messages() (*Catalog, error) {
+	b.lk.RLock()
+	c := b.catalog
+	b.lk.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	if err := b.reloadMessages(); err != nil {
+		return nil, err
+	}
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.catalog, nil
+}
+
+// messageData is what the templates get for a message to a user, in the
+// locale of their profile. Messages for everyone in a channel are for "" and
+// get the default locale.
+func (b *Bot) messageData(ctx context.Context, userId string) *MessageData {
+	cfg := b.cfg()
+	d := &MessageData{Bot: cfg.UserName, BotName: cfg.LongName, Team: cfg.PublicTeamName, Admins: cfg.Admins}
+	if userId != "" {
+		if user, resp := b.api(ctx).GetUser(userId, ""); resp.Error == nil {
+			d.User, d.Locale = user.Username, user.Locale
+		}
+	}
+	team := b.publicTeam
+	d.channels = func() []string {
+		if team == nil {
+			return nil
+		}
+		return b.PublicChannels(ctx, team.Id)
+	}
+	return d
+}
+
+// PublicChannels returns the names of a team's public channels, sorted
+func (b *Bot) PublicChannels(ctx context.Context, teamId string) (names []string) {
+	for _, c := range b.publicChannels(ctx, teamId) {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (b *Bot) publicChannels(ctx context.Context, teamId string) (channels []*model.Channel) {
+	const perPage = 200
+	for page := 0; ; page++ {
+		batch, resp := b.api(ctx).GetPublicChannelsForTeam(teamId, page, perPage, "")
+		if resp.Error != nil {
+			PrintError(resp.Error)
+			break
+		}
+		for _, c := range batch {
+			if c.Type == model.CHANNEL_OPEN {
+				channels = append(channels, c)
+			}
+		}
+		if len(batch) < perPage {
+			break
+		}
+	}
+	return
+}
+
+// RenderMessage renders the template called name from the message catalog
+func (b *Bot) RenderMessage(name string, data *MessageData) (string, error) {
+	c, err := b.messages()
+	if err != nil {
+		return "", err
+	}
+	return c.Render(name, data)
+}
+
+// Phrase renders one of the short messages for a user, with value as its
+// {{.Value}}. If that doesn't work the name is better than nothing.
+func (b *Bot) Phrase(ctx context.Context, userId, name, value string) string {
+	return b.Say(ctx, userId, name, func(d *MessageData) { d.Value = value })
+}
+
+// Say renders a message for a user like Phrase, for messages about more than
+// one thing: fill adds them to the data
+func (b *Bot) Say(ctx context.Context, userId, name string, fill func(d *MessageData)) string {
+	data := b.messageData(ctx, userId)
+	fill(data)
+	text, err := b.RenderMessage(name, data)
+	if err != nil {
+		fmt.Printf("couldn't render the %s message: %v\n", name, err)
+		return name
+	}
+	return text
+}
+
+// HandlePreviewCommand renders a template for the requester, or lists the
+// templates if none is named
+func (b *Bot) HandlePreviewCommand(inv *Invocation) error {
+	c, err := b.messages()
+	if err != nil {
+		inv.Reply(fmt.Sprintf("I couldn't load the messages:\n```\n%v\n```", err))
+		return nil
+	}
+	name := inv.Arg("template")
+	if name == "" {
+		inv.Reply(fmt.Sprintf("These are the messages in `%s`, loaded %s UTC: `%s`\n\nThey're in `%s`. People whose locale isn't one of those get `%s`.", c.dir,
+			c.loaded.UTC().Format("Jan 2 15:04"), strings.Join(c.Names(), "`, `"), strings.Join(c.Locales(), "`, `"), c.defaultLocale))
+		return nil
+	}
+	name, _ = messageName(name)
+	if !c.Has(name) {
+		inv.Reply(fmt.Sprintf("There's no message called `%s`. Try one of `%s`.", name, strings.Join(c.Names(), "`, `")))
+		return nil
+	}
+
+	userId := inv.Post.UserId
+	if as := strings.TrimPrefix(inv.Flag("as"), "@"); as != "" {
+		user, resp := b.api(inv.Context()).GetUserByUsername(as, "")
+		if resp.Error != nil {
+			inv.Reply(inv.Phrase("unknown-user", as))
+			return nil
+		}
+		userId = user.Id
+	}
+	// the sample says what the message is about, and the user who it's for
+	data, user := sampleMessageData(), b.messageData(inv.Context(), userId)
+	data.User, data.Locale, data.Bot, data.BotName, data.Team, data.Admins, data.channels = user.User, user.Locale, user.Bot, user.BotName,
+		user.Team, user.Admins, user.channels
+	if locale := inv.Flag("locale"); locale != "" {
+		data.Locale = locale
+	}
+	text, err := c.Render(name, data)
+	if err != nil {
+		inv.Reply(fmt.Sprintf("`%s` doesn't render:\n```\n%v\n```", name, err))
+		return nil
+	}
+	inv.Reply(fmt.Sprintf("Here's `%s` in `%s` as @%s would get it:\n***\n%s", name, c.Locale(data.Locale), data.User, text))
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShippedMessages(t *testing.T) {
+	c, err := LoadCatalog("messages", defaultLocale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Locales()) < 2 {
+		t.Errorf("got the locales %v, want the translations too", c.Locales())
+	}
+	for _, name := range requiredMessages {
+		if !c.Has(name) {
+			t.Errorf("there's no %s message", name)
+		}
+	}
+
+	data := sampleMessageData()
+	for _, locale := range c.Locales() {
+		if c.Locale(locale) != locale {
+			t.Errorf("%s: messages for it come from %s", locale, c.Locale(locale))
+		}
+		data.Locale = locale
+		for _, name := range c.Names() {
+			text, err := c.Render(name, data)
+			switch {
+			case err != nil:
+				t.Errorf("%s/%s: %v", locale, name, err)
+			case strings.TrimSpace(text) == "":
+				t.Errorf("%s/%s is empty", locale, name)
+			case strings.Contains(text, "<no value>"):
+				t.Errorf("%s/%s uses something it doesn't get: %q", locale, name, text)
+			}
+		}
+	}
+}
+
+// writeCatalog makes a catalog in a temporary directory where every required
+// message is in en and es, changed by files: path in the catalog -> contents,
+// "" for none
+func writeCatalog(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := make(map[string]string)
+	for _, locale := range []string{"en", "es"} {
+		os.Mkdir(filepath.Join(dir, locale), 0755)
+		for _, name := range requiredMessages {
+			all[locale+"/"+name+".md"] = "hi {{.User}}"
+		}
+	}
+	for path, text := range files {
+		all[path] = text
+	}
+	for path, text := range all {
+		if text == "" {
+			continue
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, path), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadCatalogRejects(t *testing.T) {
+	dir := writeCatalog(t, nil)
+	defer os.RemoveAll(dir)
+	if _, err := LoadCatalog(dir, "en"); err != nil {
+		t.Fatalf("a complete catalog doesn't load: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"a required message is missing", map[string]string{"en/welcome.md": "", "es/welcome.md": ""}},
+		{"a translation is missing a message", map[string]string{"es/tips.md": ""}},
+		{"a translation has an extra message", map[string]string{"es/extra.md": "hola"}},
+		{"a template doesn't parse", map[string]string{"es/tips.md": "{{if .User}}"}},
+		{"a template uses a field that doesn't exist", map[string]string{"en/tips.md": "{{.Nope}}"}},
+		{"a message is there twice", map[string]string{"en/strings.yaml": "tips: hi"}},
+	}
+	for _, tt := range tests {
+		dir := writeCatalog(t, tt.files)
+		defer os.RemoveAll(dir)
+		if _, err := LoadCatalog(dir, "en"); err == nil {
+			t.Errorf("%s: the catalog loaded", tt.name)
+		}
+	}
+}
+
+func TestCommandRepliesInTheReadersLocale(t *testing.T) {
+	tests := []struct {
+		msg      string
+		want     []string // in the reply
+		notWants []string
+	}{
+		{`@holobot time "3pm`, []string{"falta cerrar unas comillas"}, []string{"couldn't read"}},
+		{"@holobot hepl", []string{"No conozco el comando `hepl`. ¿Quisiste decir `help`?", "Escribe `@holobot help`"}, []string{"Did you mean", "Type"}},
+		{"@holobot help --nope", []string{"No conozco la opción `--nope`.", "Uso: `@holobot help"}, []string{"Unknown flag", "Usage:"}},
+		{"@holobot moderation", []string{"Falta el subcomando.", "Uso:"}, []string{"Missing subcommand"}},
+		{"@holobot help --private", []string{"| Comando | Descripción |"}, []string{"| Command |"}},
+		{"@holobot help time --private", []string{"Añade `--public`", "Ejemplos:"}, []string{"Add `--public`", "Examples:"}},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		tb.s.Users[tb.alice.Id].Locale = "es"
+		tb.config.Admins = []string{"alice"}
+		if err := tb.HandleCommands(context.Background(), tb.post(tb.alice, tb.town, tt.msg)); err != nil {
+			t.Fatal(err)
+		}
+		if len(tb.s.Ephemeral) != 1 {
+			t.Errorf("%q: got %d replies only alice sees, want 1", tt.msg, len(tb.s.Ephemeral))
+			continue
+		}
+		reply := tb.s.Ephemeral[0].Post.Message
+		for _, want := range tt.want {
+			if !strings.Contains(reply, want) {
+				t.Errorf("%q: got %q, want %q in it", tt.msg, reply, want)
+			}
+		}
+		for _, notWant := range tt.notWants {
+			if strings.Contains(reply, notWant) {
+				t.Errorf("%q: got %q, which has %q in English", tt.msg, reply, notWant)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"net/http"
+)
+
+// ChatClient is the part of the Mattermost API that holobot uses. A *model.Client4
+// satisfies it directly, and the tests' FakeServer is an in-memory implementation
+// so the handlers can be exercised without a live Mattermost.
+type ChatClient interface {
+	GetOldClientConfig(etag string) (map[string]string, *model.Response)
+	Login(loginId string, password string) (*model.User, *model.Response)
+	SetToken(token string)
+	GetMe(etag string) (*model.User, *model.Response)
+
+	GetUser(userId, etag string) (*model.User, *model.Response)
+	GetUserByUsername(userName, etag string) (*model.User, *model.Response)
+	UpdateUser(user *model.User) (*model.User, *model.Response)
+
+	GetTeam(teamId, etag string) (*model.Team, *model.Response)
+	GetTeamByName(name, etag string) (*model.Team, *model.Response)
+	GetTeamsForUser(userId, etag string) ([]*model.Team, *model.Response)
+
+	GetChannel(channelId, etag string) (*model.Channel, *model.Response)
+	GetChannelByName(channelName, teamId string, etag string) (*model.Channel, *model.Response)
+	GetPublicChannelsForTeam(teamId string, page int, perPage int, etag string) ([]*model.Channel, *model.Response)
+	CreateChannel(channel *model.Channel) (*model.Channel, *model.Response)
+	CreateDirectChannel(userId1, userId2 string) (*model.Channel, *model.Response)
+	AddChannelMember(channelId, userId string) (*model.ChannelMember, *model.Response)
+	UpdateChannelMemberSchemeRoles(channelId string, userId string, schemeRoles *model.SchemeRoles) (bool, *model.Response)
+	GetChannelMember(channelId, userId, etag string) (*model.ChannelMember, *model.Response)
+
+	CreatePost(post *model.Post) (*model.Post, *model.Response)
+	CreatePostEphemeral(post *model.PostEphemeral) (*model.Post, *model.Response)
+	GetPost(postId string, etag string) (*model.Post, *model.Response)
+	PatchPost(postId string, patch *model.PostPatch) (*model.Post, *model.Response)
+	GetPostsSince(channelId string, time int64) (*model.PostList, *model.Response)
+	GetPostsForChannel(channelId string, page, perPage int, etag string) (*model.PostList, *model.Response)
+	DeletePost(postId string) (bool, *model.Response)
+	GetFileInfosForPost(postId string, etag string) ([]*model.FileInfo, *model.Response)
+
+	SaveReaction(reaction *model.Reaction) (*model.Reaction, *model.Response)
+	DeleteReaction(reaction *model.Reaction) (bool, *model.Response)
+}
+
+var _ ChatClient = (*model.Client4)(nil)
+
+// withContext returns a client whose requests are abandoned once ctx is done.
+// A *model.Client4 gets a copy with an HTTP client that sends every request
+// with ctx; other clients, like FakeServer, answer at once and are returned as
+// they are.
+func withContext(ctx context.Context, client ChatClient) ChatClient {
+	if c, ok := client.(*model.Client4); ok {
+		hc := http.Client{}
+		if c.HttpClient != nil {
+			hc = *c.HttpClient
+		}
+		hc.Transport = &contextTransport{ctx: ctx, next: hc.Transport}
+		cc := *c
+		cc.HttpClient = &hc
+		return &cc
+	}
+	return client
+}
+
+// contextTransport sends requests with its context
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(req.WithContext(t.ctx))
+}
+
+// api returns the bot's client with its requests tied to ctx
+func (b *Bot) api(ctx context.Context) ChatClient {
+	return withContext(ctx, b.client)
+}
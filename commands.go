@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type CommandHandler func(inv *Invocation) error
+
+type Command struct {
+	Name        string
+	Description string
+	Usage       string   // overrides the generated usage line, e.g. "@holobot time"
+	Examples    []string // example messages, shown in help
+	Category    string   // commands are grouped by category in help
+	Visibility  Visibility
+	Replies     ReplyMode // where replies go unless the user asks otherwise with --public, --private or --dm
+	Args        []Arg
+	Flags       []Flag
+	Subcommands []Command
+	Handler     CommandHandler
+}
+
+// Visibility controls who sees a command in help and who may run it
+type Visibility int
+
+const (
+	VisibilityPublic Visibility = iota
+	VisibilityAdmin             // only listed for, and runnable by, admins
+	VisibilityHidden            // runnable by anyone but never listed
+)
+
+// ReplyMode is where a command's replies go
+type ReplyMode int
+
+const (
+	ReplyDefault ReplyMode = iota // whatever the parent command does, a thread reply for top-level commands
+	ReplyThread                   // a normal post in the invocation's thread
+	ReplyPrivate                  // an ephemeral post only the invoker can see
+	ReplyDM                       // a direct message to the invoker
+)
+
+// replyFlags work on every command and override its ReplyMode
+var replyFlags = []Flag{
+	Flag{Name: "public", Description: "reply in the thread for everyone to see", Bool: true},
+	Flag{Name: "private", Description: "reply so only you can see it", Bool: true},
+	Flag{Name: "dm", Description: "reply by direct message", Bool: true},
+}
+
+// Arg describes a positional argument of a command
+type Arg struct {
+	Name     string
+	Required bool
+	Variadic bool // takes all remaining positional arguments, must be last
+}
+
+// Flag describes a `--name value` (or `--name` for Bool flags) option of a command
+type Flag struct {
+	Name        string
+	Description string
+	Bool        bool
+	Default     string
+}
+
+// Invocation is a parsed `@holobot <command> [subcommand...] [args] [--flags]` mention
+type Invocation struct {
+	Event   *model.WebSocketEvent
+	Post    *model.Post
+	Command *Command
+	Path    []string // command and subcommand names, e.g. ["time", "zones", "add"]
+	Args    []string // positional arguments in order
+	Mode    ReplyMode
+
+	named map[string][]string
+	flags map[string]string
+	bot   *Bot
+	ctx   context.Context
+}
+
+// Context returns the context of the event the command came in, which is
+// cancelled if the command takes too long
+func (inv *Invocation) Context() context.Context {
+	if inv.ctx == nil {
+		return context.Background()
+	}
+	return inv.ctx
+}
+
+// Arg returns the value of a named positional argument, with variadic
+// arguments joined by spaces
+func (inv *Invocation) Arg(name string) string {
+	return strings.Join(inv.named[name], " ")
+}
+
+// ArgList returns every value given for a named positional argument
+func (inv *Invocation) ArgList(name string) []string {
+	return inv.named[name]
+}
+
+// Flag returns the value of a flag, or its default if it wasn't given
+func (inv *Invocation) Flag(name string) string {
+	if v, ok := inv.flags[name]; ok {
+		return v
+	}
+	for _, f := range inv.Command.Flags {
+		if f.Name == name {
+			return f.Default
+		}
+	}
+	return ""
+}
+
+// Bool reports whether a boolean flag was given
+func (inv *Invocation) Bool(name string) bool {
+	_, ok := inv.flags[name]
+	return ok
+}
+
+// Reply sends msg wherever the invocation's replies go
+func (inv *Invocation) Reply(msg string) {
+	switch inv.Mode {
+	case ReplyPrivate:
+		inv.bot.SendEphemeralMessage(inv.Context(), inv.Post.ChannelId, inv.Post.UserId, msg, threadRoot(inv.Post))
+	case ReplyDM:
+		inv.bot.SendDirectMessage(inv.Context(), inv.Post.UserId, msg)
+	default:
+		inv.bot.SendMsgToChannel(inv.Context(), inv.Post.ChannelId, msg, threadRoot(inv.Post))
+	}
+}
+
+// Phrase renders a short message from the catalog for a reply, in the language
+// of whoever gets it: the invoker if only they see it, otherwise the default
+func (inv *Invocation) Phrase(name, value string) string {
+	return inv.Say(name, func(d *MessageData) { d.Value = value })
+}
+
+// Say is Phrase for messages about more than one thing, which fill adds
+func (inv *Invocation) Say(name string, fill func(d *MessageData)) string {
+	return inv.bot.Say(inv.Context(), inv.recipient(), name, fill)
+}
+
+// recipient is who replies are for: the invoker when only they see them,
+// otherwise "", everyone in the channel
+func (inv *Invocation) recipient() string {
+	if inv.Mode == ReplyPrivate || inv.Mode == ReplyDM {
+		return inv.Post.UserId
+	}
+	return ""
+}
+
+// Sender returns the username of whoever invoked the command
+func (inv *Invocation) Sender() string {
+	sender, _ := inv.Event.Data["sender_name"].(string)
+	return strings.TrimPrefix(sender, "@")
+}
+
+// Debug shows msg to the invoker alone, and only when debugging is on
+func (inv *Invocation) Debug(msg string) {
+	if inv.bot.cfg().Debugging {
+		inv.bot.SendEphemeralMessage(inv.Context(), inv.Post.ChannelId, inv.Post.UserId, msg, threadRoot(inv.Post))
+	}
+}
+
+func threadRoot(post *model.Post) string {
+	if post.RootId != "" {
+		return post.RootId
+	}
+	return post.Id
+}
+
+// UsageError is returned when an invocation doesn't match its command's
+// schema. Key names the message in the catalog that says what's wrong, e.g.
+// "command-unknown-flag", and Value is what it's about.
+type UsageError struct {
+	Command    *Command
+	Path       []string
+	Key, Value string
+	Guess      string // the subcommand they probably meant
+}
+
+func (e *UsageError) Error() string {
+	return strings.TrimSpace(e.Key + " " + e.Value)
+}
+
+// errUnterminatedQuote is what Tokenize says about a quote that isn't closed
+var errUnterminatedQuote = errors.New("unterminated quote")
+
+// Tokenize splits a command line into words. Words can be quoted with single
+// or double quotes (including the “curly” kind clients like to insert) and a
+// backslash escapes the next character. A quote in the middle of a word, as in
+// "let's", is just part of the word.
+func Tokenize(line string) (tokens []string, err error) {
+	var cur strings.Builder
+	inToken := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+			inToken = true
+		case quote != 0:
+			if r == quote || (quote == '“' && r == '”') {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case !inToken && (r == '"' || r == '\'' || r == '“'):
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, errUnterminatedQuote
+	}
+	if inToken || escaped {
+		tokens = append(tokens, cur.String())
+	}
+	return
+}
+
+// CommandLine returns what follows the first `@holobot` mention in the message
+// that is followed by a command-like word, up to the end of that line.
+func (b *Bot) CommandLine(message string) string {
+	re := regexp.MustCompile(`(?:^|\W)@` + regexp.QuoteMeta(b.cfg().UserName) + `(\s+[A-Za-z][\w-]*(?:\s.*)?)$`)
+	for _, l := range strings.Split(message, "\n") {
+		// the mention isn't always at the start of the line, e.g. "9 AM EST? @holobot time"
+		if m := re.FindStringSubmatchIndex(l); m != nil {
+			return strings.TrimSpace(l[m[2]:m[3]])
+		}
+	}
+	return ""
+}
+
+// FindCommand looks up a registered command by name
+func (b *Bot) FindCommand(name string) *Command {
+	commands := b.registeredCommands()
+	for i := range commands {
+		if strings.EqualFold(commands[i].Name, name) {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// registeredCommands returns the current command registry, which is replaced
+// wholesale when the config is reloaded
+func (b *Bot) registeredCommands() []Command {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.commands
+}
+
+// Parse resolves a tokenized command line against the registered commands
+func (b *Bot) Parse(tokens []string, isAdmin bool) (inv *Invocation, err error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("no command given")
+	}
+	cmd := b.FindCommand(tokens[0])
+	if cmd == nil || (cmd.Visibility == VisibilityAdmin && !isAdmin) {
+		return nil, &UnknownCommandError{Name: tokens[0], Suggestion: b.suggestCommand(tokens[0], b.VisibleCommands(isAdmin))}
+	}
+	inv = &Invocation{Command: cmd, Path: []string{cmd.Name}, named: make(map[string][]string), flags: make(map[string]string), bot: b}
+
+	inv.Mode = cmd.Replies
+	rest := tokens[1:]
+	// descend into subcommands
+	for len(rest) > 0 && len(inv.Command.Subcommands) > 0 {
+		var sub *Command
+		for i := range inv.Command.Subcommands {
+			if strings.EqualFold(inv.Command.Subcommands[i].Name, rest[0]) {
+				sub = &inv.Command.Subcommands[i]
+				break
+			}
+		}
+		if sub == nil {
+			break
+		}
+		inv.Command = sub
+		inv.Path = append(inv.Path, sub.Name)
+		if sub.Replies != ReplyDefault {
+			inv.Mode = sub.Replies
+		}
+		rest = rest[1:]
+	}
+	cmd = inv.Command
+	if cmd.Handler == nil {
+		e := &UsageError{Command: cmd, Path: inv.Path, Key: "command-missing-subcommand"}
+		if len(rest) > 0 {
+			e.Key, e.Value, e.Guess = "command-unknown-subcommand", rest[0], b.suggestCommand(rest[0], cmd.Subcommands)
+		}
+		return nil, e
+	}
+
+	// split flags from positional arguments
+	flagsDone := false
+	for i := 0; i < len(rest); i++ {
+		tok := rest[i]
+		if flagsDone || !strings.HasPrefix(tok, "--") || len(tok) == 2 {
+			if tok == "--" && !flagsDone {
+				flagsDone = true
+				continue
+			}
+			inv.Args = append(inv.Args, tok)
+			continue
+		}
+		name, value := tok[2:], ""
+		hasValue := false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+		var flag *Flag
+		for _, flags := range [][]Flag{cmd.Flags, replyFlags} {
+			for j := range flags {
+				if flag == nil && flags[j].Name == name {
+					flag = &flags[j]
+				}
+			}
+		}
+		if flag == nil {
+			return nil, &UsageError{Command: cmd, Path: inv.Path, Key: "command-unknown-flag", Value: name}
+		}
+		if !flag.Bool && !hasValue {
+			if i+1 >= len(rest) {
+				return nil, &UsageError{Command: cmd, Path: inv.Path, Key: "command-flag-needs-value", Value: name}
+			}
+			i++
+			value = rest[i]
+		}
+		inv.flags[name] = value
+	}
+
+	switch {
+	case inv.Bool("public"):
+		inv.Mode = ReplyThread
+	case inv.Bool("private"):
+		inv.Mode = ReplyPrivate
+	case inv.Bool("dm"):
+		inv.Mode = ReplyDM
+	}
+
+	// match positional arguments to the schema
+	args := inv.Args
+	for _, a := range cmd.Args {
+		if len(args) == 0 {
+			if a.Required {
+				return nil, &UsageError{Command: cmd, Path: inv.Path, Key: "command-missing-argument", Value: a.Name}
+			}
+			continue
+		}
+		if a.Variadic {
+			inv.named[a.Name] = args
+			args = nil
+			break
+		}
+		inv.named[a.Name] = []string{args[0]}
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		return nil, &UsageError{Command: cmd, Path: inv.Path, Key: "command-unexpected-argument", Value: args[0]}
+	}
+	return
+}
+
+// UnknownCommandError is returned by Parse for a name that isn't a command
+type UnknownCommandError struct {
+	Name       string
+	Suggestion string
+}
+
+func (e *UnknownCommandError) Error() string {
+	return "unknown command " + e.Name
+}
+
+// ParseErrorText says what's wrong with a command line, for whoever reads it
+func (b *Bot) ParseErrorText(ctx context.Context, reader string, err error) string {
+	switch e := err.(type) {
+	case *UsageError:
+		return b.Say(ctx, reader, e.Key, func(d *MessageData) { d.Value, d.Guess = e.Value, e.Guess })
+	case *UnknownCommandError:
+		return b.Say(ctx, reader, "command-unknown", func(d *MessageData) { d.Value, d.Guess = e.Name, e.Suggestion })
+	case nil:
+		return ""
+	}
+	if err == errUnterminatedQuote {
+		return b.Phrase(ctx, reader, "command-unterminated-quote", "")
+	}
+	return err.Error()
+}
+
+// suggestCommand returns the name closest to the typo, if any is close enough
+func (b *Bot) suggestCommand(name string, cmds []Command) (best string) {
+	name = strings.ToLower(name)
+	bestDist := len(name)/3 + 1
+	if bestDist < 2 {
+		bestDist = 2
+	}
+	bestDist++
+	for _, c := range cmds {
+		if d := editDistance(name, strings.ToLower(c.Name)); d < bestDist {
+			best, bestDist = c.Name, d
+		}
+	}
+	return
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Usage renders the usage line and flag list of a (sub)command for whoever
+// reads it
+func (b *Bot) Usage(ctx context.Context, reader string, path []string, cmd *Command) string {
+	usage := b.Phrase(ctx, reader, "command-usage", b.UsageLine(path, cmd))
+	for _, s := range cmd.Subcommands {
+		usage += fmt.Sprintf("\n* `%s`: %s", s.Name, s.Description)
+	}
+	for _, f := range cmd.Flags {
+		usage += fmt.Sprintf("\n* `--%s`: %s", f.Name, f.Description)
+		if f.Default != "" {
+			usage += " " + b.Phrase(ctx, reader, "command-flag-default", f.Default)
+		}
+	}
+	return usage
+}
+
+// UsageLine renders the one-line synopsis of a (sub)command
+func (b *Bot) UsageLine(path []string, cmd *Command) string {
+	if cmd.Usage != "" {
+		return cmd.Usage
+	}
+	line := "@" + b.cfg().UserName + " " + strings.Join(path, " ")
+	if len(cmd.Subcommands) > 0 && cmd.Handler == nil {
+		var names []string
+		for _, s := range cmd.Subcommands {
+			names = append(names, s.Name)
+		}
+		line += " <" + strings.Join(names, "|") + ">"
+	}
+	for _, a := range cmd.Args {
+		name := a.Name
+		if a.Variadic {
+			name += "..."
+		}
+		if a.Required {
+			line += " <" + name + ">"
+		} else {
+			line += " [" + name + "]"
+		}
+	}
+	for _, f := range cmd.Flags {
+		if f.Bool {
+			line += " [--" + f.Name + "]"
+		} else {
+			line += " [--" + f.Name + " <" + f.Name + ">]"
+		}
+	}
+	return line
+}
+
+func (b *Bot) HandleCommands(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	// If this isn't the debugging channel then let's ingore it
+	// if event.Broadcast.ChannelId != b.debuggingChannel.Id {
+	// 	return
+	// }
+	if b.cfg().Debugging {
+		println("checking for commands via HandleCommands")
+	}
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	if post == nil {
+		return
+	}
+	// ignore my events
+	if post.UserId == b.botUser.Id {
+		return
+	}
+
+	// ignore anything that doesn't say @holobot followed by something
+	line := b.CommandLine(post.Message)
+	if line == "" {
+		return
+	}
+
+	// mistakes are nobody else's business
+	reply := func(msg string) {
+		b.SendEphemeralMessage(ctx, post.ChannelId, post.UserId, msg, threadRoot(post))
+	}
+	tokens, err := Tokenize(line)
+	if err != nil {
+		reply(b.ParseErrorText(ctx, post.UserId, err))
+		return nil
+	}
+	inv, err := b.Parse(tokens, b.IsAdmin(ctx, post.UserId))
+	if err != nil {
+		switch e := err.(type) {
+		case *UsageError:
+			reply(b.ParseErrorText(ctx, post.UserId, e) + "\n\n" + b.Usage(ctx, post.UserId, e.Path, e.Command))
+		case *UnknownCommandError:
+			reply(b.ParseErrorText(ctx, post.UserId, e) + " " + b.Phrase(ctx, post.UserId, "command-see-help", ""))
+		}
+		return nil
+	}
+	inv.Event = event
+	inv.Post = post
+	inv.ctx = ctx
+	return inv.Command.Handler(inv)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHandleCommands(t *testing.T) {
+	tests := []struct {
+		msg               string
+		public, ephemeral int
+		want              string // in the reply
+	}{
+		{"@holobot help", 0, 1, "time"},
+		{"@holobot help --public", 1, 0, "time"},
+		{"@holobot hepl", 0, 1, "Did you mean `help`?"},
+		{"@holobot help --nope", 0, 1, "Unknown flag `--nope`."},
+		{"@holobot time 3pm ET", 1, 0, "| PT |"},
+		{"@holobot time zones add Nowhere/Atlantis", 1, 0, "`Nowhere/Atlantis`"},
+		{"what time is it?", 0, 0, ""},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		if err := tb.HandleCommands(context.Background(), tb.post(tb.alice, tb.town, tt.msg)); err != nil {
+			t.Fatal(err)
+		}
+		if len(tb.s.Created) != tt.public || len(tb.s.Ephemeral) != tt.ephemeral {
+			t.Errorf("%q: got %d posts and %d ephemeral ones, want %d and %d", tt.msg, len(tb.s.Created), len(tb.s.Ephemeral), tt.public, tt.ephemeral)
+			continue
+		}
+		var reply string
+		for _, p := range tb.s.Created {
+			reply += p.Message
+		}
+		for _, p := range tb.s.Ephemeral {
+			if p.UserID != tb.alice.Id {
+				t.Errorf("%q: an ephemeral reply went to %s", tt.msg, p.UserID)
+			}
+			reply += p.Post.Message
+		}
+		if !strings.Contains(reply, tt.want) {
+			t.Errorf("%q: got %q, want %q in it", tt.msg, reply, tt.want)
+		}
+	}
+}
+
+func TestHandleCommandsIgnoresOurOwnPosts(t *testing.T) {
+	tb := newTestBot(t)
+	tb.HandleCommands(context.Background(), tb.post(tb.botUser, tb.town, "@holobot help --public"))
+	if len(tb.s.Created) != 0 || len(tb.s.Ephemeral) != 0 {
+		t.Errorf("answered a command of our own")
+	}
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type Config struct {
+	LongName          string
+	Admins            []string // usernames allowed to run admin commands, on top of system admins
+	UserName          string
+	UserEmail         string
+	UserFirst         string
+	UserLast          string
+	UserPassword      string
+	AccessToken       string // personal access token or bot account token, used instead of the password
+	AccessTokenFile   string // file containing the access token
+	PublicTeamName    string
+	PrivateTeamName   string
+	DebuggingTeamName string
+	LogChannel        string
+	Domain            string
+	StatePath         string // where to keep state across restarts, defaults to state/<Domain>
+	Debugging         bool
+
+	Workers        int    // how many events are handled at once, default 4
+	QueueSize      int    // how many events may wait per worker, default 256
+	HandlerTimeout string // how long an action may take before it's cancelled, default "30s"
+
+	TimeZones        []TimeZone        // the columns of the `time` table, channels and users can override them
+	TimeZoneAliases  map[string]string // extra names for zones, e.g. {"BRT": "America/Sao_Paulo"}
+	AutoTimeEmoji    string            // the reaction channels in `time auto react` mode get, default "clock3"
+	AutoTimeCooldown string            // least time between automatic time replies in a channel, default "10m"
+
+	// what may be posted where, by default only announcements in ~announcements
+	ModerationRules []ModerationRule
+
+	// what happens when someone joins a team, by default new members of the
+	// public team are added to ~announcements and get the Onboarding DMs
+	TeamWelcomes []TeamWelcome
+
+	// the DMs new members of the public team get over their first days, by
+	// default a welcome, channel suggestions, tips and a check-in after a week
+	Onboarding []OnboardingStep
+	// what the public channels are about, to suggest them to new members with
+	// matching interests, e.g. {"app-dev": ["development", "rust"]}. Channels
+	// without tags are matched by their name, purpose and header.
+	ChannelTags map[string][]string
+
+	// where the templates of holobot's messages are, default "messages", with a
+	// directory for each locale. People get them in the locale of their profile,
+	// or in DefaultLocale (default "en") if there's no directory for it.
+	MessagesPath  string
+	DefaultLocale string
+
+	// the audit log of what holobot did, kept in AuditPath (default <StatePath>/audit)
+	// and rotated every AuditMaxSize MB (default 10), keeping AuditMaxFiles old files (default 10)
+	AuditPath     string
+	AuditMaxSize  int
+	AuditMaxFiles int
+
+	// how often to check the config file for changes, e.g. "30s". Changes are
+	// also picked up on SIGHUP. Empty or "0" turns watching off.
+	ReloadInterval string
+
+	path string // the file this config was loaded from
+}
+
+// StateDir is where the bot keeps its FileStore. Bots for different servers
+// get different directories by default so they can share a working directory.
+func (cfg *Config) StateDir() string {
+	if cfg.StatePath != "" {
+		return cfg.StatePath
+	}
+	return filepath.Join("state", cfg.Domain)
+}
+
+// Token returns the configured access token, reading AccessTokenFile if that's
+// where it is. It returns "" when the bot should log in with its password.
+func (cfg *Config) Token() (string, error) {
+	if cfg.AccessToken != "" {
+		return cfg.AccessToken, nil
+	}
+	if cfg.AccessTokenFile == "" {
+		return "", nil
+	}
+	data, err := ReadFile(cfg.AccessTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ConfigError is a problem with a config file, pointing at the offending line
+// when we can work it out
+type ConfigError struct {
+	File string
+	Line int // 0 if unknown
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+// ConfigErrors collects every problem found in a config file so they can all be
+// fixed in one go
+type ConfigErrors []*ConfigError
+
+func (errs ConfigErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// fields that are only read when the bot starts, so changing them needs a restart
+var restartOnlyFields = []string{"LongName", "UserName", "UserEmail", "UserFirst", "UserLast", "UserPassword", "AccessToken", "AccessTokenFile",
+	"PublicTeamName", "PrivateTeamName", "DebuggingTeamName", "Domain", "StatePath",
+	"Workers", "QueueSize", "HandlerTimeout", "AuditPath", "AuditMaxSize", "AuditMaxFiles"}
+
+// LoadConfigs reads the config file at path, or every config file in path if it
+// is a directory.
+func LoadConfigs(path string) (configs []Config, err error) {
+	var files []string
+	if DirExists(path) {
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(path)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && EncodingFormat(entry.Name()) != "" {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			err = fmt.Errorf("no config files found in %s", path)
+			return
+		}
+	} else {
+		files = []string{path}
+	}
+
+	for _, fn := range files {
+		var cfg Config
+		if cfg, err = LoadConfig(fn); err != nil {
+			return
+		}
+		configs = append(configs, cfg)
+	}
+	return
+}
+
+// LoadConfig reads a single config file in any format EncodingFormat knows
+// (yaml if it can't tell), applies the HOLOBOT_* environment overrides and
+// validates the result.
+func LoadConfig(fn string) (cfg Config, err error) {
+	format := EncodingFormat(fn)
+	if format == "" {
+		format = "yaml"
+	}
+	data, err := ReadFile(fn)
+	if err != nil {
+		err = fmt.Errorf("couldn't open config file: %v", err)
+		return
+	}
+	if err = Decode(bytes.NewReader(data), format, &cfg); err != nil {
+		err = ConfigErrors{decodeError(fn, data, err)}
+		return
+	}
+	cfg.path = fn
+
+	var errs ConfigErrors
+	errs = append(errs, unknownFields(fn, data, format)...)
+	if err = cfg.applyEnv(os.Getenv); err != nil {
+		errs = append(errs, &ConfigError{File: fn, Msg: err.Error()})
+	}
+	errs = append(errs, cfg.Validate(data)...)
+	if len(errs) > 0 {
+		err = errs
+	}
+	return
+}
+
+// decodeError turns an error from Decode into a ConfigError with a line number
+func decodeError(fn string, data []byte, err error) *ConfigError {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &ConfigError{File: fn, Line: lineAt(data, e.Offset), Msg: e.Error()}
+	case *json.UnmarshalTypeError:
+		return &ConfigError{File: fn, Line: lineAt(data, e.Offset), Msg: e.Error()}
+	}
+	// yaml and toml errors name the line themselves, but yaml type errors come
+	// out of its conversion to json and only name the field
+	msg := err.Error()
+	if m := regexp.MustCompile(`Go struct field \w*\.(\w+)`).FindStringSubmatch(msg); m != nil {
+		return &ConfigError{File: fn, Line: keyLine(data, m[1]), Msg: msg}
+	}
+	if m := regexp.MustCompile(`line (\d+)`).FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &ConfigError{File: fn, Line: line, Msg: msg}
+	}
+	return &ConfigError{File: fn, Msg: msg}
+}
+
+// lineAt returns the 1-based line containing the byte offset
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// keyLine returns the line a top-level key is set on, or 0 if it isn't there
+func keyLine(data []byte, key string) int {
+	re := regexp.MustCompile(`(?im)^\s*["']?` + regexp.QuoteMeta(key) + `["']?\s*[:=]`)
+	loc := re.FindIndex(data)
+	if loc == nil {
+		return 0
+	}
+	return lineAt(data, int64(loc[0]))
+}
+
+// unknownFields reports keys in the file that don't match any Config field,
+// which is usually a typo
+func unknownFields(fn string, data []byte, format string) (errs ConfigErrors) {
+	var raw map[string]interface{}
+	if err := Decode(bytes.NewReader(data), format, &raw); err != nil {
+		return
+	}
+	known := make(map[string]string)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			known[strings.ToLower(t.Field(i).Name)] = t.Field(i).Name
+		}
+	}
+	var keys []string
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, ok := known[strings.ToLower(k)]; ok {
+			continue
+		}
+		msg := fmt.Sprintf("unknown setting %q", k)
+		best, bestDist := "", 3
+		for _, name := range known {
+			if d := editDistance(strings.ToLower(k), strings.ToLower(name)); d < bestDist {
+				best, bestDist = name, d
+			}
+		}
+		if best != "" {
+			msg += fmt.Sprintf(", did you mean %q?", best)
+		}
+		errs = append(errs, &ConfigError{File: fn, Line: keyLine(data, k), Msg: msg})
+	}
+	return
+}
+
+// Validate checks that the settings make sense. data is the file the config
+// was read from and is only used to point errors at the right line.
+func (cfg *Config) Validate(data []byte) (errs ConfigErrors) {
+	fail := func(field, msg string) {
+		errs = append(errs, &ConfigError{File: cfg.path, Line: keyLine(data, field), Msg: field + " " + msg})
+	}
+	required := map[string]string{
+		"Domain":            cfg.Domain,
+		"UserName":          cfg.UserName,
+		"PublicTeamName":    cfg.PublicTeamName,
+		"PrivateTeamName":   cfg.PrivateTeamName,
+		"DebuggingTeamName": cfg.DebuggingTeamName,
+	}
+	if cfg.Debugging {
+		required["LogChannel"] = cfg.LogChannel
+	}
+	var names []string
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.TrimSpace(required[name]) == "" {
+			fail(name, "must be set")
+		}
+	}
+
+	switch {
+	case cfg.AccessToken != "" && cfg.AccessTokenFile != "":
+		fail("AccessTokenFile", "can't be used together with AccessToken")
+	case cfg.AccessTokenFile != "" && !FileExists(cfg.AccessTokenFile):
+		fail("AccessTokenFile", fmt.Sprintf("%q doesn't exist", cfg.AccessTokenFile))
+	case cfg.AccessToken == "" && cfg.AccessTokenFile == "":
+		// no token, so we need a password login
+		if cfg.UserEmail == "" {
+			fail("UserEmail", "must be set when there's no AccessToken or AccessTokenFile")
+		}
+		if cfg.UserPassword == "" {
+			fail("UserPassword", "must be set when there's no AccessToken or AccessTokenFile")
+		}
+	}
+
+	if strings.Contains(cfg.Domain, "://") || strings.Contains(cfg.Domain, "/") {
+		fail("Domain", fmt.Sprintf("should be a bare host name like chat.example.com, not %q", cfg.Domain))
+	}
+	if strings.HasPrefix(cfg.UserName, "@") {
+		fail("UserName", "shouldn't start with @")
+	}
+	if _, err := cfg.reloadInterval(); err != nil {
+		fail("ReloadInterval", err.Error())
+	}
+	if _, err := cfg.handlerTimeout(); err != nil {
+		fail("HandlerTimeout", err.Error())
+	}
+	if cfg.Workers < 0 {
+		fail("Workers", "can't be negative")
+	}
+	if cfg.QueueSize < 0 {
+		fail("QueueSize", "can't be negative")
+	}
+	if cfg.MessagesPath != "" && !DirExists(cfg.MessagesPath) {
+		fail("MessagesPath", fmt.Sprintf("%q doesn't exist", cfg.MessagesPath))
+	}
+	if cfg.AuditMaxSize < 0 {
+		fail("AuditMaxSize", "can't be negative")
+	}
+	if cfg.AuditMaxFiles < 0 {
+		fail("AuditMaxFiles", "can't be negative")
+	}
+	if _, err := cfg.autoTimeCooldown(); err != nil {
+		fail("AutoTimeCooldown", err.Error())
+	}
+	for i := range cfg.ModerationRules {
+		for _, problem := range cfg.ModerationRules[i].validate() {
+			fail("ModerationRules", problem)
+		}
+	}
+	for _, problem := range validateOnboarding(cfg.Onboarding) {
+		fail("Onboarding", problem)
+	}
+	for _, problem := range validateTeamWelcomes(cfg.TeamWelcomes) {
+		fail("TeamWelcomes", problem)
+	}
+	for name, tags := range cfg.ChannelTags {
+		if len(tags) == 0 {
+			fail("ChannelTags", fmt.Sprintf("%q has no tags", name))
+		}
+	}
+	for _, z := range cfg.TimeZones {
+		if z.Label == "" {
+			fail("TimeZones", fmt.Sprintf("entry for %q needs a Label", z.Location))
+		}
+		if _, err := time.LoadLocation(z.Location); err != nil || z.Location == "" {
+			fail("TimeZones", fmt.Sprintf("has an unknown Location %q", z.Location))
+		}
+	}
+	for name, loc := range cfg.TimeZoneAliases {
+		if _, err := time.LoadLocation(loc); err != nil || loc == "" {
+			fail("TimeZoneAliases", fmt.Sprintf("maps %q to an unknown location %q", name, loc))
+		}
+	}
+	return
+}
+
+func (cfg *Config) reloadInterval() (time.Duration, error) {
+	if cfg.ReloadInterval == "" || cfg.ReloadInterval == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(cfg.ReloadInterval)
+	if err != nil {
+		return 0, fmt.Errorf("isn't a duration like \"30s\": %v", err)
+	}
+	return d, nil
+}
+
+func (cfg *Config) handlerTimeout() (time.Duration, error) {
+	if cfg.HandlerTimeout == "" {
+		return defaultHandlerTimeout, nil
+	}
+	d, err := time.ParseDuration(cfg.HandlerTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("isn't a duration like \"30s\": %v", err)
+	}
+	return d, nil
+}
+
+// EnvName returns the environment variable that overrides a Config field,
+// e.g. HOLOBOT_USER_PASSWORD for UserPassword
+func EnvName(field string) string {
+	var b strings.Builder
+	b.WriteString("HOLOBOT")
+	runes := []rune(field)
+	for i, r := range runes {
+		// a new word starts at an upper case letter that follows a lower case
+		// one, or that starts a capitalised word after an acronym
+		if i == 0 || unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			b.WriteString("_")
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv overrides fields from HOLOBOT_* environment variables. Strings are
+// taken as is, booleans and numbers are parsed, lists are comma separated and
+// anything else is given as JSON.
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := EnvName(field.Name)
+		val := getenv(name)
+		if val == "" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			f.SetInt(n)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(val), "[") {
+				var list []string
+				for _, item := range strings.Split(val, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						list = append(list, item)
+					}
+				}
+				f.Set(reflect.ValueOf(list))
+				continue
+			}
+			fallthrough
+		default:
+			if err := json.Unmarshal([]byte(val), f.Addr().Interface()); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// cfg returns the bot's current config. It's replaced as a whole when the
+// config is reloaded, so callers may keep the pointer for the length of a handler.
+func (b *Bot) cfg() *Config {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.config
+}
+
+// Reload re-reads the bot's config file and swaps in the new settings without
+// touching the websocket connection. Settings that are only used at startup
+// keep their old values until the bot is restarted. A SIGHUP and the file
+// watcher may both ask for a reload; they take turns.
+func (b *Bot) Reload() error {
+	b.reloading.Lock()
+	defer b.reloading.Unlock()
+	old := b.cfg()
+	if old.path == "" {
+		return nil
+	}
+	cfg, err := LoadConfig(old.path)
+	if err != nil {
+		fmt.Printf("couldn't reload %s, keeping the old config:\n%v\n", old.path, err)
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("**Couldn't reload the config, keeping the old one:**\n```\n%v\n```", err), "")
+		return err
+	}
+
+	newV, oldV := reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(old).Elem()
+	for _, name := range restartOnlyFields {
+		if !reflect.DeepEqual(newV.FieldByName(name).Interface(), oldV.FieldByName(name).Interface()) {
+			fmt.Printf("%s changed in %s, restart holobot for it to take effect\n", name, old.path)
+			newV.FieldByName(name).Set(oldV.FieldByName(name))
+		}
+	}
+
+	b.lk.Lock()
+	b.config = &cfg
+	b.lk.Unlock()
+
+	if cfg.Debugging && b.DebuggingChannel() == nil {
+		b.CreateBotDebuggingChannelIfNeeded(context.Background())
+	}
+	b.reloadMessages()
+	b.registerActions()
+	b.registerCommands()
+	b.registerModeration(context.Background())
+	b.checkMessages()
+	b.watchConfig()
+	println("Reloaded the config from " + old.path)
+	b.SendMsgToDebuggingChannel("_Reloaded the config_", "")
+	return nil
+}
+
+// watchConfig (re)starts polling the config file for changes
+func (b *Bot) watchConfig() {
+	b.lk.Lock()
+	interval, _ := b.config.reloadInterval()
+	if b.stopWatching != nil {
+		if interval == b.watchInterval {
+			b.lk.Unlock()
+			return
+		}
+		b.stopWatching <- true
+		b.stopWatching = nil
+	}
+	b.watchInterval = interval
+	path, dir := b.config.path, b.config.MessagesDir()
+	// b.cfg() and the file system are used without holding b.lk from here on
+	b.lk.Unlock()
+	if interval == 0 || path == "" {
+		return
+	}
+
+	last := configModified(path, dir)
+	stop := Ticker(interval, func() {
+		cfg := b.cfg()
+		if m := configModified(cfg.path, cfg.MessagesDir()); !m.Equal(last) {
+			last = m
+			go b.Reload()
+		}
+	})
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.stopWatching != nil || b.watchInterval != interval {
+		// another watch started in the meantime
+		stop <- true
+		return
+	}
+	b.stopWatching = stop
+}
+
+// configModified returns when the config or any of the messages last changed
+func configModified(path, messagesDir string) (last time.Time) {
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	if m := messagesModified(messagesDir); m.After(last) {
+		last = m
+	}
+	return
+}
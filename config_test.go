@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchedBot is a test bot whose config was loaded from a file in a temporary
+// directory, next to its messages, and is checked for changes every few
+// milliseconds
+func watchedBot(t *testing.T) (tb *testBot, dir string) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "messages", "en"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "messages", "en", "welcome.md"), []byte("hi"), 0644)
+	config := `Domain: chat.example.com
+UserName: holobot
+UserEmail: holobot@example.com
+UserPassword: secret
+PublicTeamName: public
+PrivateTeamName: staff
+DebuggingTeamName: debugging
+MessagesPath: ` + filepath.Join(dir, "messages") + `
+ReloadInterval: 10ms
+`
+	ioutil.WriteFile(filepath.Join(dir, "holobot.yaml"), []byte(config), 0644)
+
+	tb = newTestBot(t)
+	cfg, err := LoadConfig(filepath.Join(dir, "holobot.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.config = &cfg
+	return tb, dir
+}
+
+// waitForReload reports whether the bot's config is replaced within a second
+func waitForReload(tb *testBot, old *Config) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if tb.cfg() != old {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bot) stopWatchingConfig() {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.stopWatching != nil {
+		b.stopWatching <- true
+		b.stopWatching = nil
+	}
+}
+
+// touch makes a file look changed
+func touch(path string) {
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+}
+
+func TestWatchConfig(t *testing.T) {
+	tb, dir := watchedBot(t)
+	defer os.RemoveAll(dir)
+
+	started := make(chan bool)
+	go func() {
+		tb.watchConfig()
+		started <- true
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("watchConfig didn't return")
+	}
+	defer tb.stopWatchingConfig()
+
+	old := tb.cfg()
+	touch(filepath.Join(dir, "holobot.yaml"))
+	if !waitForReload(tb, old) {
+		t.Error("a change to the config file wasn't picked up")
+	}
+}
+
+func TestWatchConfigMessages(t *testing.T) {
+	tb, dir := watchedBot(t)
+	defer os.RemoveAll(dir)
+	tb.watchConfig()
+	defer tb.stopWatchingConfig()
+
+	old := tb.cfg()
+	touch(filepath.Join(dir, "messages", "en", "welcome.md"))
+	if !waitForReload(tb, old) {
+		t.Error("a change to the messages wasn't picked up")
+	}
+}
+
+// loadConfig writes a config file with the given settings after the required
+// ones, which take up the first seven lines, and loads it
+func loadConfig(t *testing.T, settings string) (Config, string, error) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "holobot.yaml")
+	config := `Domain: chat.example.com
+UserName: holobot
+UserEmail: holobot@example.com
+UserPassword: secret
+PublicTeamName: public
+PrivateTeamName: staff
+DebuggingTeamName: debugging
+` + settings
+	ioutil.WriteFile(fn, []byte(config), 0644)
+	cfg, err := LoadConfig(fn)
+	return cfg, fn, err
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		settings string
+		want     string // the error, after the file name
+	}{
+		{"", ""},
+		{"Workers: 2\nReloadInterval: soon\n", `:9: ReloadInterval isn't a duration like "30s"`},
+		{"AccessToken: abc\nAccessTokenFile: token\n", `:9: AccessTokenFile can't be used together with AccessToken`},
+		{"Debugging: true\n", `: LogChannel must be set`},
+		{"Workers: lots\n", `:8: `},
+		{"Workers: 2\nUserPasword: secret\n", `:9: unknown setting "UserPasword", did you mean "UserPassword"?`},
+		{"Whatever: 1\n", `:8: unknown setting "Whatever"`},
+	}
+	for _, tt := range tests {
+		_, fn, err := loadConfig(t, tt.settings)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.settings, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), fn+tt.want) {
+			t.Errorf("%q: got %v, want %s%s", tt.settings, err, fn, tt.want)
+		}
+		if strings.Contains(tt.want, "Whatever") && strings.Contains(err.Error(), "did you mean") {
+			t.Errorf("%q: suggested a setting for %v", tt.settings, err)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"HOLOBOT_USER_PASSWORD":     "from-env",
+		"HOLOBOT_WORKERS":           "8",
+		"HOLOBOT_DEBUGGING":         "true",
+		"HOLOBOT_ADMINS":            "alice, bob,",
+		"HOLOBOT_HANDLER_TIMEOUT":   "45s",
+		"HOLOBOT_TIME_ZONE_ALIASES": `{"BRT": "America/Sao_Paulo"}`,
+	}
+	cfg := Config{UserPassword: "from-file", Workers: 2, Admins: []string{"carol"}}
+	if err := cfg.applyEnv(func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.UserPassword != "from-env" || cfg.Workers != 8 || !cfg.Debugging {
+		t.Errorf("got %q, %d and %v", cfg.UserPassword, cfg.Workers, cfg.Debugging)
+	}
+	if strings.Join(cfg.Admins, ",") != "alice,bob" {
+		t.Errorf("got the admins %q", cfg.Admins)
+	}
+	if timeout, err := cfg.handlerTimeout(); timeout != 45*time.Second || err != nil {
+		t.Errorf("got the timeout %v (%v)", timeout, err)
+	}
+	if cfg.TimeZoneAliases["BRT"] != "America/Sao_Paulo" {
+		t.Errorf("got the aliases %v", cfg.TimeZoneAliases)
+	}
+
+	// lists can be json too, and what's not in the environment is left alone
+	cfg = Config{UserName: "holobot"}
+	env = map[string]string{"HOLOBOT_ADMINS": `["alice, the first"]`}
+	cfg.applyEnv(func(name string) string { return env[name] })
+	if len(cfg.Admins) != 1 || cfg.Admins[0] != "alice, the first" || cfg.UserName != "holobot" {
+		t.Errorf("got %q and %q", cfg.Admins, cfg.UserName)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"HOLOBOT_WORKERS", "lots"},
+		{"HOLOBOT_DEBUGGING", "maybe"},
+		{"HOLOBOT_TIME_ZONE_ALIASES", "BRT=America/Sao_Paulo"},
+	}
+	for _, tt := range tests {
+		var cfg Config
+		err := cfg.applyEnv(func(name string) string {
+			if name == tt.name {
+				return tt.value
+			}
+			return ""
+		})
+		if err == nil || !strings.HasPrefix(err.Error(), tt.name+": ") {
+			t.Errorf("%s=%s: got %v", tt.name, tt.value, err)
+		}
+	}
+
+	// durations are checked with the rest of the config
+	os.Setenv("HOLOBOT_HANDLER_TIMEOUT", "soon")
+	defer os.Unsetenv("HOLOBOT_HANDLER_TIMEOUT")
+	if _, _, err := loadConfig(t, ""); err == nil || !strings.Contains(err.Error(), "HandlerTimeout isn't a duration") {
+		t.Errorf("HOLOBOT_HANDLER_TIMEOUT=soon: got %v", err)
+	}
+}
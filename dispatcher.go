@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"hash/fnv"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWorkers        = 4
+	defaultQueueSize      = 256
+	defaultHandlerTimeout = 30 * time.Second
+)
+
+// Dispatcher runs the actions for incoming events on a pool of workers so a
+// slow handler doesn't hold up every other event. Events are routed to workers
+// by channel, so the events of any one channel are still handled in order.
+type Dispatcher struct {
+	queues  []chan *model.WebSocketEvent
+	wg      sync.WaitGroup
+	timeout time.Duration
+
+	dispatched uint64 // events queued
+	blocked    uint64 // times the reader had to wait for a full queue
+	maxDepth   int64  // deepest any queue has been
+
+	lk    sync.Mutex
+	stats map[string]*HandlerStats
+}
+
+// HandlerStats counts how an action has been doing
+type HandlerStats struct {
+	Runs     int
+	Errors   int
+	Panics   int
+	Timeouts int
+	Total    time.Duration
+	Slowest  time.Duration
+}
+
+func NewDispatcher(bot *Bot, workers, queueSize int, timeout time.Duration) *Dispatcher {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	if timeout <= 0 {
+		timeout = defaultHandlerTimeout
+	}
+	d := &Dispatcher{timeout: timeout, stats: make(map[string]*HandlerStats)}
+	for i := 0; i < workers; i++ {
+		q := make(chan *model.WebSocketEvent, queueSize)
+		d.queues = append(d.queues, q)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for event := range q {
+				bot.runActions(event)
+			}
+		}()
+	}
+	return d
+}
+
+// Dispatch queues an event for its channel's worker, waiting if that worker is
+// too far behind.
+func (d *Dispatcher) Dispatch(event *model.WebSocketEvent) {
+	q := d.queues[d.worker(event)]
+	atomic.AddUint64(&d.dispatched, 1)
+	select {
+	case q <- event:
+	default:
+		atomic.AddUint64(&d.blocked, 1)
+		q <- event
+	}
+	depth := int64(len(q))
+	for {
+		max := atomic.LoadInt64(&d.maxDepth)
+		if depth <= max || atomic.CompareAndSwapInt64(&d.maxDepth, max, depth) {
+			break
+		}
+	}
+}
+
+// worker picks the queue for an event: by channel when it has one, otherwise by
+// the user it's about
+func (d *Dispatcher) worker(event *model.WebSocketEvent) int {
+	key := ""
+	if event.Broadcast != nil {
+		key = event.Broadcast.ChannelId
+		if key == "" {
+			key = event.Broadcast.UserId
+		}
+	}
+	if key == "" {
+		if id, ok := event.Data["user_id"].(string); ok {
+			key = id
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(d.queues)))
+}
+
+// Stop waits for the queued events to be handled and stops the workers
+func (d *Dispatcher) Stop() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+// runAction runs one action's handler with a deadline, recovering from panics.
+// The handler's context is cancelled at the deadline, which abandons its API
+// calls. A handler that doesn't return once it's cancelled is left behind and
+// reported, so one stuck action can't hold up its worker's other channels. It
+// works on a nil Dispatcher too, it just doesn't keep stats then.
+func (d *Dispatcher) runAction(b *Bot, a Action, event *model.WebSocketEvent) {
+	timeout := defaultHandlerTimeout
+	if d != nil {
+		timeout = d.timeout
+	}
+	if a.Timeout > 0 {
+		timeout = a.Timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		err   error
+		panic interface{}
+		stack []byte
+	}
+	done := make(chan result, 1)
+	started := time.Now()
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{panic: p, stack: debug.Stack()}
+			}
+		}()
+		done <- result{err: a.Handler(ctx, event)}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		fmt.Printf("action %s took longer than %v on a %s event, moving on without it\n", a.Name, timeout, event.Event)
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("**Action _%s_ took longer than %v** on a `%s` event, moving on without it", a.Name, timeout, event.Event), "")
+		if d != nil {
+			d.record(a.Name, time.Since(started), true, false, false)
+		}
+		// done is buffered, so the handler can still finish whenever it does
+		go func() {
+			r := <-done
+			if r.panic != nil {
+				reportPanic(b, a, event, r.panic, r.stack)
+				return
+			}
+			fmt.Printf("action %s finally returned after %v: %v\n", a.Name, time.Since(started).Round(time.Millisecond), r.err)
+		}()
+		return
+	}
+	if d != nil {
+		d.record(a.Name, time.Since(started), false, r.panic != nil, r.err != nil)
+	}
+
+	switch {
+	case r.panic != nil:
+		reportPanic(b, a, event, r.panic, r.stack)
+	case r.err != nil:
+		fmt.Printf("error running action %s:%v\n", a.Name, r.err)
+	}
+}
+
+func reportPanic(b *Bot, a Action, event *model.WebSocketEvent, p interface{}, stack []byte) {
+	fmt.Printf("action %s panicked: %v\n%s\n", a.Name, p, stack)
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("**Action _%s_ panicked** on a `%s` event: %v\n```\n%s\n```", a.Name, event.Event, p, stack), "")
+}
+
+func (d *Dispatcher) record(name string, elapsed time.Duration, timedOut, panicked, failed bool) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	st := d.stats[name]
+	if st == nil {
+		st = &HandlerStats{}
+		d.stats[name] = st
+	}
+	st.Runs++
+	st.Total += elapsed
+	if elapsed > st.Slowest {
+		st.Slowest = elapsed
+	}
+	switch {
+	case timedOut:
+		st.Timeouts++
+	case panicked:
+		st.Panics++
+	case failed:
+		st.Errors++
+	}
+}
+
+// Stats renders the queue depths and per-action counters
+func (d *Dispatcher) Stats() string {
+	var depths []string
+	for i, q := range d.queues {
+		depths = append(depths, fmt.Sprintf("%d: %d/%d", i, len(q), cap(q)))
+	}
+	text := fmt.Sprintf("**Events dispatched:** %d, **waited on a full queue:** %d, **deepest queue:** %d\n**Queue depths:** %s\n\n",
+		atomic.LoadUint64(&d.dispatched), atomic.LoadUint64(&d.blocked), atomic.LoadInt64(&d.maxDepth), strings.Join(depths, ", "))
+
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	var names []string
+	for name := range d.stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text += "| Action | Runs | Errors | Panics | Timeouts | Average | Slowest |\n|---|---|---|---|---|---|---|\n"
+	for _, name := range names {
+		st := d.stats[name]
+		avg := time.Duration(0)
+		if st.Runs > 0 {
+			avg = st.Total / time.Duration(st.Runs)
+		}
+		text += fmt.Sprintf("| %s | %d | %d | %d | %d | %v | %v |\n", name, st.Runs, st.Errors, st.Panics, st.Timeouts,
+			avg.Round(time.Millisecond), st.Slowest.Round(time.Millisecond))
+	}
+	return text
+}
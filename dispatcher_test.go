@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunActionCancelsAtTheDeadline(t *testing.T) {
+	b := NewWithClient(Config{}, nil, NewMemStore())
+	d := &Dispatcher{timeout: time.Second, stats: make(map[string]*HandlerStats)}
+
+	cause := make(chan error, 1)
+	release := make(chan bool)
+	stuck := Action{Name: "stuck", Timeout: 10 * time.Millisecond, Handler: func(ctx context.Context, event *model.WebSocketEvent) error {
+		<-ctx.Done()
+		cause <- ctx.Err()
+		// a handler that ignores being cancelled mustn't hold up the worker
+		<-release
+		return ctx.Err()
+	}}
+	returned := make(chan bool)
+	go func() {
+		d.runAction(b, stuck, model.NewWebSocketEvent(model.WEBSOCKET_EVENT_POSTED, "", "c1", "", nil))
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("runAction waited for a handler that was past its deadline")
+	}
+	close(release)
+	if err := <-cause; err != context.DeadlineExceeded {
+		t.Errorf("the handler's context ended with %v, want %v", err, context.DeadlineExceeded)
+	}
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if st := d.stats["stuck"]; st.Runs != 1 || st.Timeouts != 1 || st.Errors != 0 {
+		t.Errorf("got %+v, want one run that timed out", *st)
+	}
+}
+
+func TestRunActionCounts(t *testing.T) {
+	b := NewWithClient(Config{}, nil, NewMemStore())
+	d := &Dispatcher{timeout: time.Second, stats: make(map[string]*HandlerStats)}
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_POSTED, "", "c1", "", nil)
+
+	actions := []Action{
+		{Name: "fine", Handler: func(ctx context.Context, event *model.WebSocketEvent) error { return nil }},
+		{Name: "failing", Handler: func(ctx context.Context, event *model.WebSocketEvent) error { return errors.New("no") }},
+		{Name: "panicking", Handler: func(ctx context.Context, event *model.WebSocketEvent) error { panic("oh no") }},
+	}
+	for _, a := range actions {
+		d.runAction(b, a, event)
+	}
+
+	tests := []struct {
+		name                    string
+		errors, panics, timeout int
+	}{
+		{"fine", 0, 0, 0},
+		{"failing", 1, 0, 0},
+		{"panicking", 0, 1, 0},
+	}
+	for _, tt := range tests {
+		st := d.stats[tt.name]
+		if st.Runs != 1 || st.Errors != tt.errors || st.Panics != tt.panics || st.Timeouts != tt.timeout {
+			t.Errorf("%s: got %+v", tt.name, *st)
+		}
+	}
+}
+
+func TestDispatcherKeepsEachChannelInOrder(t *testing.T) {
+	b := NewWithClient(Config{}, nil, NewMemStore())
+	var lk sync.Mutex
+	seen := make(map[string][]string)
+	b.actions = []Action{{Name: "record", Handler: func(ctx context.Context, event *model.WebSocketEvent) error {
+		lk.Lock()
+		defer lk.Unlock()
+		channel := event.Broadcast.ChannelId
+		seen[channel] = append(seen[channel], event.Data["n"].(string))
+		return nil
+	}}}
+	b.dispatcher = NewDispatcher(b, 3, 2, time.Second)
+
+	for _, n := range []string{"1", "2", "3", "4", "5"} {
+		for _, channel := range []string{"c1", "c2", "c3"} {
+			event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_POSTED, "", channel, "", nil)
+			event.Data["n"] = n
+			b.HandleWebSocketResponse(event)
+		}
+	}
+	b.dispatcher.Stop()
+
+	for _, channel := range []string{"c1", "c2", "c3"} {
+		if got := strings.Join(seen[channel], ","); got != "1,2,3,4,5" {
+			t.Errorf("%s: got %s, want 1,2,3,4,5", channel, got)
+		}
+	}
+}
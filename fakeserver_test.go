@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeServer is an in-memory ChatClient. It keeps just enough of a Mattermost
+// server's state (users, teams, channels, posts, memberships) for the handlers
+// to run against, and records everything the bot does so it can be checked
+// afterwards.
+type FakeServer struct {
+	mu sync.Mutex
+
+	Users     map[string]*model.User
+	Passwords map[string]string // login id (email or username) -> password
+	Tokens    map[string]string // access token -> user id
+	Teams     map[string]*model.Team
+	Channels  map[string]*model.Channel
+	Posts     map[string]*model.Post
+
+	TeamMembers    map[string]map[string]bool    // team id -> user ids
+	ChannelMembers map[string]map[string]bool    // channel id -> user ids
+	ChannelRoles   map[string]string             // "<channel id>:<user id>" -> roles on top of channel_user
+	SchemeRoles    map[string]*model.SchemeRoles // "<channel id>:<user id>" -> scheme roles the bot set
+	Files          map[string][]*model.FileInfo  // post id -> attachments
+
+	// Failing makes the next calls of a method fail like a server in trouble:
+	// method name -> how many of them
+	Failing map[string]int
+
+	// what the bot did, in order
+	Created          []*model.Post
+	Ephemeral        []*model.PostEphemeral
+	Deleted          []string
+	Patched          []string
+	AddedMembers     []*model.ChannelMember
+	SavedReactions   []*model.Reaction
+	DeletedReactions []*model.Reaction
+
+	session *model.User // who is logged in, nil once the session expires
+	nextId  int
+}
+
+func NewFakeServer() *FakeServer {
+	return &FakeServer{
+		Users:          make(map[string]*model.User),
+		Passwords:      make(map[string]string),
+		Tokens:         make(map[string]string),
+		Teams:          make(map[string]*model.Team),
+		Channels:       make(map[string]*model.Channel),
+		Posts:          make(map[string]*model.Post),
+		TeamMembers:    make(map[string]map[string]bool),
+		ChannelMembers: make(map[string]map[string]bool),
+		ChannelRoles:   make(map[string]string),
+		SchemeRoles:    make(map[string]*model.SchemeRoles),
+		Files:          make(map[string][]*model.FileInfo),
+		Failing:        make(map[string]int),
+	}
+}
+
+// Fixture helpers ---------------------------------------
+
+func (s *FakeServer) newId() string {
+	s.nextId++
+	return fmt.Sprintf("fake%022d", s.nextId)
+}
+
+// AddUser registers a user that can log in with its email or username and password.
+func (s *FakeServer) AddUser(username, email, password string) *model.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &model.User{Id: s.newId(), Username: username, Email: email}
+	s.Users[u.Id] = u
+	s.Passwords[email] = password
+	s.Passwords[username] = password
+	return u
+}
+
+// AddBotAccount registers a bot account that authenticates with the returned access token.
+func (s *FakeServer) AddBotAccount(username string) (*model.User, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &model.User{Id: s.newId(), Username: username, IsBot: true}
+	s.Users[u.Id] = u
+	token := s.newId()
+	s.Tokens[token] = u.Id
+	return u, token
+}
+
+func (s *FakeServer) AddTeam(name string) *model.Team {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &model.Team{Id: s.newId(), Name: name, DisplayName: name}
+	s.Teams[t.Id] = t
+	s.TeamMembers[t.Id] = make(map[string]bool)
+	return t
+}
+
+func (s *FakeServer) AddChannel(name string, team *model.Team) *model.Channel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &model.Channel{Id: s.newId(), Name: name, DisplayName: name, Type: model.CHANNEL_OPEN, TeamId: team.Id}
+	s.Channels[c.Id] = c
+	s.ChannelMembers[c.Id] = make(map[string]bool)
+	return c
+}
+
+// JoinTeam makes the user a member of the team.
+func (s *FakeServer) JoinTeam(userId string, team *model.Team) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.TeamMembers[team.Id][userId] = true
+}
+
+// AddPost stores a post as if a user had made it, without recording it as
+// something the bot created.
+func (s *FakeServer) AddPost(post *model.Post) *model.Post {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storePost(post)
+}
+
+func (s *FakeServer) storePost(post *model.Post) *model.Post {
+	p := *post
+	if p.Id == "" {
+		p.Id = s.newId()
+	}
+	if p.CreateAt == 0 {
+		p.CreateAt = model.GetMillis()
+	}
+	p.UpdateAt = p.CreateAt
+	s.Posts[p.Id] = &p
+	return &p
+}
+
+// PostsInChannel returns the undeleted posts in a channel, oldest first.
+func (s *FakeServer) PostsInChannel(channelId string) (posts []*model.Post) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.Posts {
+		if p.ChannelId == channelId && p.DeleteAt == 0 {
+			posts = append(posts, p)
+		}
+	}
+	// posts made within the same millisecond are in the order they were made
+	sort.Slice(posts, func(i, j int) bool {
+		return posts[i].CreateAt < posts[j].CreateAt || posts[i].CreateAt == posts[j].CreateAt && posts[i].Id < posts[j].Id
+	})
+	return
+}
+
+// IsChannelMember reports whether the user is in the channel.
+func (s *FakeServer) IsChannelMember(channelId, userId string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ChannelMembers[channelId][userId]
+}
+
+// MakeChannelAdmin gives a channel member the channel_admin role.
+func (s *FakeServer) MakeChannelAdmin(channelId, userId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ChannelMembers[channelId][userId] = true
+	s.ChannelRoles[channelId+":"+userId] = model.CHANNEL_ADMIN_ROLE_ID
+}
+
+// ExpireSession logs the client out, as if its token had expired.
+func (s *FakeServer) ExpireSession() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = nil
+}
+
+// Event builders ----------------------------------------
+
+// PostedEvent builds the websocket event Mattermost broadcasts for a new post.
+func (s *FakeServer) PostedEvent(post *model.Post) *model.WebSocketEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_POSTED, "", post.ChannelId, "", nil)
+	event.Data["post"] = post.ToJson()
+	if u := s.Users[post.UserId]; u != nil {
+		event.Data["sender_name"] = u.Username
+	}
+	if c := s.Channels[post.ChannelId]; c != nil {
+		event.Data["channel_name"] = c.Name
+		event.Data["channel_type"] = c.Type
+	}
+	return event
+}
+
+// ReactionEvent builds the websocket event for a reaction being added.
+func (s *FakeServer) ReactionEvent(reaction *model.Reaction) *model.WebSocketEvent {
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_REACTION_ADDED, "", "", "", nil)
+	event.Data["reaction"] = reaction.ToJson()
+	return event
+}
+
+// NewUserEvent builds the websocket event for a user joining the server.
+func (s *FakeServer) NewUserEvent(userId string) *model.WebSocketEvent {
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_NEW_USER, "", "", "", nil)
+	event.Data["user_id"] = userId
+	return event
+}
+
+// UserAddedEvent builds the websocket event Mattermost broadcasts to a channel's
+// members when a user is added to it, e.g. to town-square when they join the team.
+func (s *FakeServer) UserAddedEvent(channel *model.Channel, userId string) *model.WebSocketEvent {
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_USER_ADDED, "", channel.Id, "", nil)
+	event.Data["user_id"] = userId
+	event.Data["team_id"] = channel.TeamId
+	return event
+}
+
+// AddedToTeamEvent builds the websocket event a user gets when they're added to a team.
+func (s *FakeServer) AddedToTeamEvent(team *model.Team, userId string) *model.WebSocketEvent {
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_ADDED_TO_TEAM, "", "", userId, nil)
+	event.Data["user_id"] = userId
+	event.Data["team_id"] = team.Id
+	return event
+}
+
+// ChatClient --------------------------------------------
+
+func fakeOK() *model.Response {
+	return &model.Response{StatusCode: http.StatusOK}
+}
+
+// failing returns the error for a call that's made to fail by Failing, nil
+// for one that goes ahead. The caller must hold s.mu.
+func (s *FakeServer) failing(method string) *model.Response {
+	if s.Failing[method] == 0 {
+		return nil
+	}
+	s.Failing[method]--
+	return fakeErr("FakeServer."+method, "api.context.500", http.StatusInternalServerError)
+}
+
+func fakeErr(where, id string, status int) *model.Response {
+	return &model.Response{StatusCode: status, Error: model.NewAppError(where, id, nil, "", status)}
+}
+
+func (s *FakeServer) GetOldClientConfig(etag string) (map[string]string, *model.Response) {
+	return map[string]string{"Version": "fake"}, fakeOK()
+}
+
+func (s *FakeServer) Login(loginId string, password string) (*model.User, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pw, ok := s.Passwords[loginId]; !ok || pw != password {
+		return nil, fakeErr("FakeServer.Login", "api.user.login.invalid_credentials", http.StatusUnauthorized)
+	}
+	for _, u := range s.Users {
+		if u.Email == loginId || u.Username == loginId {
+			s.session = u
+			c := *u
+			return &c, fakeOK()
+		}
+	}
+	return nil, fakeErr("FakeServer.Login", "api.user.login.invalid_credentials", http.StatusUnauthorized)
+}
+
+func (s *FakeServer) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = s.Users[s.Tokens[token]]
+}
+
+func (s *FakeServer) GetMe(etag string) (*model.User, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil {
+		return nil, fakeErr("FakeServer.GetMe", "api.context.session_expired.app_error", http.StatusUnauthorized)
+	}
+	c := *s.Users[s.session.Id]
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) GetUser(userId, etag string) (*model.User, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.Users[userId]
+	if !ok {
+		return nil, fakeErr("FakeServer.GetUser", "store.sql_user.missing_account.const", http.StatusNotFound)
+	}
+	c := *u
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) GetUserByUsername(userName, etag string) (*model.User, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.Users {
+		if u.Username == userName {
+			c := *u
+			return &c, fakeOK()
+		}
+	}
+	return nil, fakeErr("FakeServer.GetUserByUsername", "store.sql_user.get_by_username.app_error", http.StatusNotFound)
+}
+
+func (s *FakeServer) UpdateUser(user *model.User) (*model.User, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Users[user.Id]; !ok {
+		return nil, fakeErr("FakeServer.UpdateUser", "store.sql_user.missing_account.const", http.StatusNotFound)
+	}
+	u := *user
+	s.Users[user.Id] = &u
+	c := u
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) GetTeam(teamId, etag string) (*model.Team, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.Teams[teamId]
+	if !ok {
+		return nil, fakeErr("FakeServer.GetTeam", "store.sql_team.get.find.app_error", http.StatusNotFound)
+	}
+	return t, fakeOK()
+}
+
+func (s *FakeServer) GetTeamByName(name, etag string) (*model.Team, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.Teams {
+		if t.Name == name {
+			return t, fakeOK()
+		}
+	}
+	return nil, fakeErr("FakeServer.GetTeamByName", "store.sql_team.get_by_name.app_error", http.StatusNotFound)
+}
+
+func (s *FakeServer) GetTeamsForUser(userId, etag string) ([]*model.Team, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var teams []*model.Team
+	for teamId, members := range s.TeamMembers {
+		if members[userId] {
+			teams = append(teams, s.Teams[teamId])
+		}
+	}
+	return teams, fakeOK()
+}
+
+func (s *FakeServer) GetChannel(channelId, etag string) (*model.Channel, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Channels[channelId]
+	if !ok {
+		return nil, fakeErr("FakeServer.GetChannel", "store.sql_channel.get.existing.app_error", http.StatusNotFound)
+	}
+	return c, fakeOK()
+}
+
+func (s *FakeServer) GetChannelByName(channelName, teamId string, etag string) (*model.Channel, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Channels {
+		if c.Name == channelName && c.TeamId == teamId {
+			return c, fakeOK()
+		}
+	}
+	return nil, fakeErr("FakeServer.GetChannelByName", "store.sql_channel.get_by_name.missing.app_error", http.StatusNotFound)
+}
+
+func (s *FakeServer) GetPublicChannelsForTeam(teamId string, page int, perPage int, etag string) ([]*model.Channel, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var channels []*model.Channel
+	for _, c := range s.Channels {
+		if c.TeamId == teamId && c.Type == model.CHANNEL_OPEN {
+			channels = append(channels, c)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	if page*perPage >= len(channels) {
+		return nil, fakeOK()
+	}
+	channels = channels[page*perPage:]
+	if len(channels) > perPage {
+		channels = channels[:perPage]
+	}
+	return channels, fakeOK()
+}
+
+func (s *FakeServer) CreateChannel(channel *model.Channel) (*model.Channel, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.Channels {
+		if c.Name == channel.Name && c.TeamId == channel.TeamId {
+			return nil, fakeErr("FakeServer.CreateChannel", "store.sql_channel.save_channel.exists.app_error", http.StatusBadRequest)
+		}
+	}
+	c := *channel
+	c.Id = s.newId()
+	s.Channels[c.Id] = &c
+	s.ChannelMembers[c.Id] = make(map[string]bool)
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) CreateDirectChannel(userId1, userId2 string) (*model.Channel, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Users[userId1] == nil || s.Users[userId2] == nil {
+		return nil, fakeErr("FakeServer.CreateDirectChannel", "api.channel.create_direct_channel.invalid_user.app_error", http.StatusBadRequest)
+	}
+	ids := []string{userId1, userId2}
+	sort.Strings(ids)
+	name := ids[0] + "__" + ids[1]
+	for _, c := range s.Channels {
+		if c.Type == model.CHANNEL_DIRECT && c.Name == name {
+			return c, fakeOK()
+		}
+	}
+	c := &model.Channel{Id: s.newId(), Name: name, Type: model.CHANNEL_DIRECT}
+	s.Channels[c.Id] = c
+	s.ChannelMembers[c.Id] = map[string]bool{userId1: true, userId2: true}
+	return c, fakeOK()
+}
+
+func (s *FakeServer) AddChannelMember(channelId, userId string) (*model.ChannelMember, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Channels[channelId] == nil {
+		return nil, fakeErr("FakeServer.AddChannelMember", "store.sql_channel.get.existing.app_error", http.StatusNotFound)
+	}
+	if s.Users[userId] == nil {
+		return nil, fakeErr("FakeServer.AddChannelMember", "store.sql_user.missing_account.const", http.StatusNotFound)
+	}
+	s.ChannelMembers[channelId][userId] = true
+	m := &model.ChannelMember{ChannelId: channelId, UserId: userId, Roles: "channel_user"}
+	s.AddedMembers = append(s.AddedMembers, m)
+	return m, fakeOK()
+}
+
+func (s *FakeServer) UpdateChannelMemberSchemeRoles(channelId string, userId string, schemeRoles *model.SchemeRoles) (bool, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp := s.failing("UpdateChannelMemberSchemeRoles"); resp != nil {
+		return false, resp
+	}
+	if !s.ChannelMembers[channelId][userId] {
+		return false, fakeErr("FakeServer.UpdateChannelMemberSchemeRoles", "store.sql_channel.get_member.missing.app_error", http.StatusNotFound)
+	}
+	roles := *schemeRoles
+	s.SchemeRoles[channelId+":"+userId] = &roles
+	return true, fakeOK()
+}
+
+func (s *FakeServer) GetChannelMember(channelId, userId, etag string) (*model.ChannelMember, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ChannelMembers[channelId][userId] {
+		return nil, fakeErr("FakeServer.GetChannelMember", "store.sql_channel.get_member.missing.app_error", http.StatusNotFound)
+	}
+	key := channelId + ":" + userId
+	m := &model.ChannelMember{ChannelId: channelId, UserId: userId, SchemeUser: true, SchemeAdmin: s.ChannelRoles[key] == model.CHANNEL_ADMIN_ROLE_ID}
+	if sr := s.SchemeRoles[key]; sr != nil {
+		m.SchemeUser, m.SchemeAdmin = sr.SchemeUser, sr.SchemeAdmin
+	}
+	if m.SchemeUser {
+		m.Roles = model.CHANNEL_USER_ROLE_ID
+	}
+	if m.SchemeAdmin {
+		m.Roles = strings.TrimSpace(m.Roles + " " + model.CHANNEL_ADMIN_ROLE_ID)
+	}
+	return m, fakeOK()
+}
+
+func (s *FakeServer) CreatePost(post *model.Post) (*model.Post, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Channels[post.ChannelId] == nil {
+		return nil, fakeErr("FakeServer.CreatePost", "api.post.create_post.channel_root_id.app_error", http.StatusBadRequest)
+	}
+	p := s.storePost(post)
+	s.Created = append(s.Created, p)
+	return p, fakeOK()
+}
+
+func (s *FakeServer) CreatePostEphemeral(post *model.PostEphemeral) (*model.Post, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Channels[post.Post.ChannelId] == nil {
+		return nil, fakeErr("FakeServer.CreatePostEphemeral", "api.post.create_post.channel_root_id.app_error", http.StatusBadRequest)
+	}
+	p := *post.Post
+	p.Id = s.newId()
+	p.CreateAt = model.GetMillis()
+	s.Ephemeral = append(s.Ephemeral, &model.PostEphemeral{UserID: post.UserID, Post: &p})
+	return &p, fakeOK()
+}
+
+func (s *FakeServer) GetPost(postId string, etag string) (*model.Post, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp := s.failing("GetPost"); resp != nil {
+		return nil, resp
+	}
+	p, ok := s.Posts[postId]
+	if !ok || p.DeleteAt != 0 {
+		return nil, fakeErr("FakeServer.GetPost", "store.sql_post.get.app_error", http.StatusNotFound)
+	}
+	c := *p
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) PatchPost(postId string, patch *model.PostPatch) (*model.Post, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.Posts[postId]
+	if !ok || p.DeleteAt != 0 {
+		return nil, fakeErr("FakeServer.PatchPost", "store.sql_post.get.app_error", http.StatusNotFound)
+	}
+	if patch.Message != nil {
+		p.Message = *patch.Message
+	}
+	if patch.IsPinned != nil {
+		p.IsPinned = *patch.IsPinned
+	}
+	p.EditAt = model.GetMillis()
+	p.UpdateAt = p.EditAt
+	s.Patched = append(s.Patched, postId)
+	c := *p
+	return &c, fakeOK()
+}
+
+func (s *FakeServer) GetPostsSince(channelId string, time int64) (*model.PostList, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := &model.PostList{Posts: make(map[string]*model.Post)}
+	for _, p := range s.Posts {
+		if p.ChannelId == channelId && p.UpdateAt >= time {
+			c := *p
+			list.Posts[p.Id] = &c
+			list.Order = append(list.Order, p.Id)
+		}
+	}
+	sort.Slice(list.Order, func(i, j int) bool { return list.Posts[list.Order[i]].CreateAt > list.Posts[list.Order[j]].CreateAt })
+	return list, fakeOK()
+}
+
+func (s *FakeServer) GetPostsForChannel(channelId string, page, perPage int, etag string) (*model.PostList, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Channels[channelId] == nil {
+		return nil, fakeErr("FakeServer.GetPostsForChannel", "store.sql_channel.get.existing.app_error", http.StatusNotFound)
+	}
+	var posts []*model.Post
+	for _, p := range s.Posts {
+		if p.ChannelId == channelId && p.DeleteAt == 0 {
+			posts = append(posts, p)
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].CreateAt > posts[j].CreateAt })
+	list := &model.PostList{Posts: make(map[string]*model.Post)}
+	for i := page * perPage; i < len(posts) && i < (page+1)*perPage; i++ {
+		c := *posts[i]
+		list.Posts[c.Id] = &c
+		list.Order = append(list.Order, c.Id)
+	}
+	return list, fakeOK()
+}
+
+func (s *FakeServer) GetFileInfosForPost(postId string, etag string) ([]*model.FileInfo, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Posts[postId]; !ok {
+		return nil, fakeErr("FakeServer.GetFileInfosForPost", "store.sql_post.get.app_error", http.StatusNotFound)
+	}
+	return s.Files[postId], fakeOK()
+}
+
+func (s *FakeServer) DeletePost(postId string) (bool, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if resp := s.failing("DeletePost"); resp != nil {
+		return false, resp
+	}
+	p, ok := s.Posts[postId]
+	if !ok || p.DeleteAt != 0 {
+		return false, fakeErr("FakeServer.DeletePost", "store.sql_post.get.app_error", http.StatusNotFound)
+	}
+	p.DeleteAt = model.GetMillis()
+	p.UpdateAt = p.DeleteAt
+	s.Deleted = append(s.Deleted, postId)
+	return true, fakeOK()
+}
+
+func (s *FakeServer) SaveReaction(reaction *model.Reaction) (*model.Reaction, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Posts[reaction.PostId]; !ok {
+		return nil, fakeErr("FakeServer.SaveReaction", "store.sql_post.get.app_error", http.StatusNotFound)
+	}
+	s.SavedReactions = append(s.SavedReactions, reaction)
+	return reaction, fakeOK()
+}
+
+func (s *FakeServer) DeleteReaction(reaction *model.Reaction) (bool, *model.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DeletedReactions = append(s.DeletedReactions, reaction)
+	return true, fakeOK()
+}
+
+var _ ChatClient = (*FakeServer)(nil)
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// posts waiting for their author to deal with them, by post id
+	graceNamespace = "grace"
+
+	// how often we look for grace periods that ran out
+	graceCheckInterval = 15 * time.Second
+
+	defaultMoveTo = "town-square"
+)
+
+// GracePost is a post that broke a rule with a GracePeriod. Its author can move
+// it, mark it or delete it before the Deadline, after which we delete it.
+type GracePost struct {
+	PostId    string
+	ChannelId string
+	UserId    string
+	Username  string
+	Rule      string
+	Reason    string     // why it broke the rule, as the audit log has it
+	Violation *Violation `json:",omitempty"`
+	Deadline  int64      // millis
+}
+
+// violation is why the post broke the rule, which posts from before the
+// Violation was kept only have the text of
+func (g GracePost) violation() *Violation {
+	if g.Violation != nil {
+		return g.Violation
+	}
+	return &Violation{Key: g.Reason}
+}
+
+// what authors can reply to the grace period DM: an action and, if they have
+// several posts waiting, the start of the post's id
+var graceReplyRe = regexp.MustCompile(`(?i)^\s*(move|announce|mark|delete)(?:\s+([a-z0-9]+))?\s*$`)
+
+func (r *ModerationRule) gracePeriod() time.Duration {
+	d, _ := time.ParseDuration(r.GracePeriod)
+	return d
+}
+
+// StartGracePeriod holds off deleting a post and DMs its author what they can do
+// about it
+func (b *Bot) StartGracePeriod(ctx context.Context, rule *ModerationRule, post *model.Post, sender string, v *Violation) error {
+	reason := b.ReasonText(ctx, "", v)
+	g := GracePost{PostId: post.Id, ChannelId: post.ChannelId, UserId: post.UserId, Username: sender,
+		Rule: rule.Name, Reason: reason, Violation: v, Deadline: model.GetMillis() + int64(rule.gracePeriod()/time.Millisecond)}
+	if err := b.store.Put(graceNamespace, post.Id, g); err != nil {
+		fmt.Printf("couldn't start a grace period for %s: %v\n", post.Id, err)
+		return err
+	}
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("* **It breaks the rule _%s_ because %s! Deleting it in %v unless @%s deals with it.**", rule.Name, reason, rule.gracePeriod(), sender), "")
+	b.Audit(b.postAudit(ctx, AuditGracePeriod, post, sender, rule, fmt.Sprintf("%s, deleting it in %v", reason, rule.gracePeriod())))
+
+	msg := b.Say(ctx, post.UserId, "grace-period", func(d *MessageData) {
+		if c, resp := b.api(ctx).GetChannel(post.ChannelId, ""); resp.Error == nil {
+			d.Channel = c.Name
+		}
+		d.Reason, d.Value, d.PostId = b.ReasonText(ctx, post.UserId, v), rule.gracePeriod().String(), shortId(post.Id)
+		d.Target, d.Reply, d.Tag = b.moveToName(rule), post.RootId != "", rule.MarkTag
+		d.Message, d.Quoted = post.Message, quote(post.Message)
+	})
+	e := b.postAudit(ctx, AuditSendDM, post, sender, rule, "told them how to deal with it")
+	e.Outcome = outcome(b.SendDirectMessage(ctx, post.UserId, msg))
+	b.Audit(e)
+	return nil
+}
+
+// graceAudit is an audit log entry about a post in its grace period
+func (b *Bot) graceAudit(ctx context.Context, action string, g GracePost, actor, detail string) AuditEntry {
+	return AuditEntry{Actor: actor, Action: action, PostId: g.PostId, UserId: g.UserId, Username: g.Username,
+		ChannelId: g.ChannelId, Channel: b.ChannelName(ctx, g.ChannelId), Rule: g.Rule, Detail: detail}
+}
+
+func shortId(id string) string {
+	if len(id) > 6 {
+		return id[:6]
+	}
+	return id
+}
+
+func (b *Bot) moveToName(rule *ModerationRule) string {
+	if rule.MoveTo != "" {
+		return strings.TrimPrefix(rule.MoveTo, "~")
+	}
+	return defaultMoveTo
+}
+
+// takeGracePost removes a waiting post from the store and returns it, so that
+// whoever takes it is the only one dealing with it
+func (b *Bot) takeGracePost(postId string) (g GracePost, found bool, err error) {
+	b.grace.Lock()
+	defer b.grace.Unlock()
+	if found, err = b.store.Get(graceNamespace, postId, &g); err != nil || !found {
+		return
+	}
+	err = b.store.Delete(graceNamespace, postId)
+	return
+}
+
+// GracePosts returns the posts still waiting, soonest deadline first
+func (b *Bot) GracePosts() (posts []GracePost, err error) {
+	keys, err := b.store.Keys(graceNamespace)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var g GracePost
+		if _, err = b.store.Get(graceNamespace, key, &g); err != nil {
+			return
+		}
+		posts = append(posts, g)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Deadline < posts[j].Deadline })
+	return
+}
+
+// graceRule finds the rule a waiting post broke, in case the config changed since
+func (b *Bot) graceRule(g GracePost) *ModerationRule {
+	rules := b.ModerationRules(g.ChannelId)
+	for i := range rules {
+		if rules[i].Name == g.Rule {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// ExpireGracePeriods deletes the posts whose grace period ran out, unless they
+// were edited to follow the rule in the meantime
+func (b *Bot) ExpireGracePeriods(ctx context.Context) {
+	posts, err := b.GracePosts()
+	if err != nil {
+		fmt.Printf("couldn't read the grace periods: %v\n", err)
+		return
+	}
+	now := model.GetMillis()
+	for _, waiting := range posts {
+		if waiting.Deadline > now || ctx.Err() != nil {
+			break
+		}
+		g, found, err := b.takeGracePost(waiting.PostId)
+		if err != nil || !found {
+			continue
+		}
+		post, resp := b.api(ctx).GetPost(g.PostId, "")
+		if resp.Error != nil {
+			if resp.StatusCode != http.StatusNotFound || ctx.Err() != nil {
+				// the server or we are having trouble, try again on the next tick
+				PrintError(resp.Error)
+				b.store.Put(graceNamespace, g.PostId, g)
+			}
+			// otherwise they deleted it themselves
+			continue
+		}
+		rule := b.graceRule(g)
+		if rule == nil {
+			continue
+		}
+		if rule.Check(b.moderationFacts(ctx, post, g.Username, []ModerationRule{*rule})) == nil {
+			b.SendMsgToDebuggingChannel(fmt.Sprintf("* **@%s fixed their post in time, keeping it.**", g.Username), "")
+			b.Audit(b.graceAudit(ctx, AuditKeepPost, g, "", "fixed during the grace period"))
+			b.SendDirectMessage(ctx, g.UserId, b.Phrase(ctx, g.UserId, "grace-fixed", ""))
+			continue
+		}
+		_, resp = b.api(ctx).DeletePost(g.PostId)
+		e := b.graceAudit(ctx, AuditDeletePost, g, "", g.Reason+", and the grace period ran out")
+		e.Outcome = outcome(resp.Error)
+		b.Audit(e)
+		if resp.Error != nil {
+			PrintError(resp.Error)
+			if resp.StatusCode != http.StatusNotFound {
+				b.store.Put(graceNamespace, g.PostId, g)
+			}
+			continue
+		}
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("* **The grace period of @%s's post ran out. Deleted!**", g.Username), "")
+		b.SendDirectMessage(ctx, g.UserId, b.Say(ctx, g.UserId, "grace-expired", func(d *MessageData) { d.PostId = shortId(g.PostId) }))
+		b.Escalate(ctx, rule, post, g.Username, g.violation(), b.RecordViolation(rule, g.UserId))
+	}
+}
+
+// HandleGraceReplies acts on what authors reply to the grace period DM
+func (b *Bot) HandleGraceReplies(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	name, _ := event.Data["channel_name"].(string)
+	if !b.IsBotDM(name) {
+		return
+	}
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	if post == nil || post.UserId == b.botUser.Id {
+		return
+	}
+	m := graceReplyRe.FindStringSubmatch(post.Message)
+	if m == nil {
+		return
+	}
+	action, id := strings.ToLower(m[1]), strings.ToLower(m[2])
+
+	posts, err := b.GracePosts()
+	if err != nil {
+		return
+	}
+	// the one they named, or their most recent one
+	var target *GracePost
+	for i := range posts {
+		if posts[i].UserId == post.UserId && strings.HasPrefix(strings.ToLower(posts[i].PostId), id) {
+			target = &posts[i]
+		}
+	}
+	if target == nil {
+		b.SendDirectMessage(ctx, post.UserId, b.Say(ctx, post.UserId, "grace-not-holding", func(d *MessageData) { d.PostId = id }))
+		return
+	}
+
+	g, found, err := b.takeGracePost(target.PostId)
+	if err != nil || !found {
+		return
+	}
+	original, resp := b.api(ctx).GetPost(g.PostId, "")
+	if resp.Error != nil {
+		b.SendDirectMessage(ctx, post.UserId, b.Phrase(ctx, post.UserId, "grace-gone", ""))
+		return
+	}
+	rule := b.graceRule(g)
+	if rule == nil {
+		b.SendDirectMessage(ctx, post.UserId, b.Phrase(ctx, post.UserId, "grace-rule-gone", ""))
+		return
+	}
+
+	switch action {
+	case "move":
+		err = b.moveGracePost(ctx, rule, g, original)
+	case "announce", "mark":
+		err = b.markGracePost(ctx, rule, g, original)
+	case "delete":
+		_, resp := b.api(ctx).DeletePost(g.PostId)
+		e := b.graceAudit(ctx, AuditDeletePost, g, g.Username, "asked to by its author")
+		e.Outcome = outcome(resp.Error)
+		b.Audit(e)
+		if resp.Error != nil {
+			err = resp.Error
+			break
+		}
+		b.SendDirectMessage(ctx, post.UserId, b.Phrase(ctx, post.UserId, "grace-deleted", ""))
+	}
+	if err != nil {
+		// put it back so the timeout still deals with it
+		b.store.Put(graceNamespace, g.PostId, g)
+		b.SendDirectMessage(ctx, post.UserId, b.Phrase(ctx, post.UserId, "grace-failed", ""))
+	}
+	return err
+}
+
+// moveGracePost reposts a post in the rule's MoveTo channel, on the same team,
+// and deletes the original
+func (b *Bot) moveGracePost(ctx context.Context, rule *ModerationRule, g GracePost, post *model.Post) (err error) {
+	// replies go to the discussion of what they replied to
+	if post.RootId != "" {
+		link, target, err := b.RelocateReply(ctx, rule, post, g.Username, g.Username)
+		if err != nil {
+			return err
+		}
+		b.SendDirectMessage(ctx, g.UserId, b.Say(ctx, g.UserId, "grace-moved", func(d *MessageData) { d.Link, d.Target, d.Reply = link, target.Name, true }))
+		return nil
+	}
+
+	channel, team, target, err := b.moveTarget(ctx, rule, post.ChannelId)
+	if err != nil {
+		return err
+	}
+	e := b.graceAudit(ctx, AuditMovePost, g, g.Username, "to ~"+target.Name)
+	defer func() {
+		e.Outcome = outcome(err)
+		b.Audit(e)
+	}()
+	msg := b.movedPost(ctx, "post-moved", post, g.Username, channel.Name)
+	moved, resp := b.api(ctx).CreatePost(&model.Post{ChannelId: target.Id, Message: msg})
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if _, resp := b.api(ctx).DeletePost(post.Id); resp.Error != nil {
+		return resp.Error
+	}
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("* **@%s had their post moved to ~%s.**", g.Username, target.Name), "")
+	b.SendDirectMessage(ctx, g.UserId, b.Say(ctx, g.UserId, "grace-moved", func(d *MessageData) { d.Link, d.Target = b.Permalink(team.Name, moved.Id), target.Name }))
+	return nil
+}
+
+// markGracePost adds the rule's MarkTag to a post, as long as that's all it
+// takes for it to follow the rule
+func (b *Bot) markGracePost(ctx context.Context, rule *ModerationRule, g GracePost, post *model.Post) error {
+	if rule.MarkTag == "" {
+		b.store.Put(graceNamespace, g.PostId, g)
+		b.SendDirectMessage(ctx, g.UserId, b.Phrase(ctx, g.UserId, "grace-cant-mark", ""))
+		return nil
+	}
+	marked := *post
+	marked.Message = strings.TrimRight(post.Message, " \n") + "\n\n" + rule.MarkTag
+	if v := rule.Check(b.moderationFacts(ctx, &marked, g.Username, []ModerationRule{*rule})); v != nil {
+		b.store.Put(graceNamespace, g.PostId, g)
+		b.SendDirectMessage(ctx, g.UserId, b.Say(ctx, g.UserId, "grace-mark-wont-help", func(d *MessageData) { d.Reason = b.ReasonText(ctx, g.UserId, v) }))
+		return nil
+	}
+	_, resp := b.api(ctx).PatchPost(post.Id, &model.PostPatch{Message: &marked.Message})
+	e := b.graceAudit(ctx, AuditMarkPost, g, g.Username, "added "+rule.MarkTag)
+	e.Outcome = outcome(resp.Error)
+	b.Audit(e)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("* **@%s marked their post with %s.**", g.Username, rule.MarkTag), "")
+	b.SendDirectMessage(ctx, g.UserId, b.Say(ctx, g.UserId, "grace-marked", func(d *MessageData) { d.Tag = rule.MarkTag }))
+	return nil
+}
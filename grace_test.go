@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"testing"
+)
+
+// newGraceBot is a test bot whose ~announcements rule gives authors ten minutes
+func newGraceBot(t *testing.T) *testBot {
+	tb := newTestBot(t)
+	tb.config.ModerationRules = []ModerationRule{{Name: "announcements", Channels: []string{"public/announcements"},
+		RequirePattern: announcementPattern, PatternHint: "reason-not-an-announcement", GracePeriod: "10m", MarkTag: "#announcement"}}
+	if err := tb.registerModeration(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return tb
+}
+
+func TestHandleGraceReplies(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  string // in our answer
+		check func(tb *testBot, post *model.Post) bool
+	}{
+		{"delete", "Deleted it!", func(tb *testBot, post *model.Post) bool {
+			return len(tb.s.Deleted) == 1 && tb.s.Deleted[0] == post.Id
+		}},
+		{"announce", "#announcement", func(tb *testBot, post *model.Post) bool {
+			return strings.HasSuffix(tb.s.Posts[post.Id].Message, "\n\n#announcement") && len(tb.s.Deleted) == 0
+		}},
+		{"move", "~town-square", func(tb *testBot, post *model.Post) bool {
+			moved := tb.s.PostsInChannel(tb.town.Id)
+			return len(tb.s.Deleted) == 1 && len(moved) == 1 && strings.Contains(moved[0].Message, "anyone up for lunch?")
+		}},
+		{"delete nope", "I'm not holding on to a message `nope` of yours.", func(tb *testBot, post *model.Post) bool {
+			return len(tb.s.Deleted) == 0
+		}},
+	}
+	for _, tt := range tests {
+		tb := newGraceBot(t)
+		event := tb.post(tb.alice, tb.announcements, "anyone up for lunch?")
+		if err := tb.HandleModeration(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+		dm := tb.dm(tb.alice)
+		if got := tb.sentTo(dm, 0); len(tb.s.Deleted) != 0 || len(got) != 1 || !strings.Contains(got[0], "`delete ") {
+			t.Fatalf("%q: the post wasn't held, got %q", tt.reply, got)
+		}
+
+		n := len(tb.s.Created)
+		if err := tb.HandleGraceReplies(context.Background(), tb.post(tb.alice, dm, tt.reply)); err != nil {
+			t.Fatal(err)
+		}
+		got := tb.sentTo(dm, n)
+		if len(got) != 1 || !strings.Contains(got[0], tt.want) {
+			t.Errorf("%q: got %q, want %q in it", tt.reply, got, tt.want)
+		}
+		post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+		if !tt.check(tb, post) {
+			t.Errorf("%q: deleted %v", tt.reply, tb.s.Deleted)
+		}
+	}
+}
+
+func TestExpireGracePeriods(t *testing.T) {
+	tb := newGraceBot(t)
+	var posts []*model.Post
+	for _, msg := range []string{"fixed later", "left alone"} {
+		event := tb.post(tb.alice, tb.announcements, msg)
+		tb.HandleModeration(context.Background(), event)
+		posts = append(posts, model.PostFromJson(strings.NewReader(event.Data["post"].(string))))
+	}
+	tb.ExpireGracePeriods(context.Background())
+	if len(tb.s.Deleted) != 0 {
+		t.Fatalf("deleted %v before the time was up", tb.s.Deleted)
+	}
+
+	for _, post := range posts {
+		var g GracePost
+		tb.store.Get(graceNamespace, post.Id, &g)
+		g.Deadline = 1
+		tb.store.Put(graceNamespace, post.Id, g)
+	}
+	tb.s.Posts[posts[0].Id].Message = "fixed later #announcement"
+	tb.ExpireGracePeriods(context.Background())
+	if len(tb.s.Deleted) != 1 || tb.s.Deleted[0] != posts[1].Id {
+		t.Errorf("deleted %v, want only the post that wasn't fixed", tb.s.Deleted)
+	}
+	if keys, _ := tb.store.Keys(graceNamespace); len(keys) != 0 {
+		t.Errorf("still holding %v", keys)
+	}
+}
+
+func TestExpireGracePeriodsRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing string
+		deleted bool // by its author
+		held    bool // after the first try
+	}{
+		{"the post can't be fetched", "GetPost", false, true},
+		{"the post can't be deleted", "DeletePost", false, true},
+		{"the author deleted it", "", true, false},
+	}
+	for _, tt := range tests {
+		tb := newGraceBot(t)
+		event := tb.post(tb.alice, tb.announcements, "anyone up for lunch?")
+		tb.HandleModeration(context.Background(), event)
+		post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+		var g GracePost
+		tb.store.Get(graceNamespace, post.Id, &g)
+		g.Deadline = 1
+		tb.store.Put(graceNamespace, post.Id, g)
+		if tt.deleted {
+			tb.s.Posts[post.Id].DeleteAt = 1
+		}
+
+		tb.s.Failing[tt.failing] = 1
+		tb.ExpireGracePeriods(context.Background())
+		if held, _ := tb.store.Get(graceNamespace, post.Id, &g); held != tt.held {
+			t.Errorf("%s: holding on to it is %v, want %v", tt.name, held, tt.held)
+		}
+		if !tt.held {
+			continue
+		}
+		tb.ExpireGracePeriods(context.Background())
+		if len(tb.s.Deleted) != 1 || tb.s.Deleted[0] != post.Id {
+			t.Errorf("%s: deleted %v on the next try, want the post", tt.name, tb.s.Deleted)
+		}
+	}
+}
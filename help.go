@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"sort"
+	"strings"
+)
+
+// IsAdmin reports whether the user may see and run admin commands
+func (b *Bot) IsAdmin(ctx context.Context, userId string) bool {
+	user, resp := b.api(ctx).GetUser(userId, "")
+	if resp.Error != nil {
+		return false
+	}
+	for _, name := range b.cfg().Admins {
+		if strings.TrimPrefix(name, "@") == user.Username {
+			return true
+		}
+	}
+	for _, role := range strings.Fields(user.Roles) {
+		if role == model.SYSTEM_ADMIN_ROLE_ID {
+			return true
+		}
+	}
+	return false
+}
+
+// VisibleCommands returns the commands that should be listed for a user
+func (b *Bot) VisibleCommands(isAdmin bool) (cmds []Command) {
+	for _, cmd := range b.registeredCommands() {
+		if cmd.Visibility == VisibilityHidden || (cmd.Visibility == VisibilityAdmin && !isAdmin) {
+			continue
+		}
+		cmds = append(cmds, cmd)
+	}
+	return
+}
+
+// HelpText renders the full help message, listing the commands the user can
+// run, for whoever reads it: the user, or "" for everyone in a channel
+func (b *Bot) HelpText(ctx context.Context, userId, reader string) string {
+	cmds := b.VisibleCommands(b.IsAdmin(ctx, userId))
+
+	// group by category, keeping registration order within a category
+	var categories []string
+	byCategory := make(map[string][]Command)
+	for _, cmd := range cmds {
+		if _, ok := byCategory[cmd.Category]; !ok {
+			categories = append(categories, cmd.Category)
+		}
+		byCategory[cmd.Category] = append(byCategory[cmd.Category], cmd)
+	}
+	sort.SliceStable(categories, func(i, j int) bool {
+		// uncategorized commands come first
+		return categories[i] == "" && categories[j] != ""
+	})
+
+	data := b.messageData(ctx, reader)
+	text := b.helpMessage("help-intro", data) + "\n\n"
+	for _, category := range categories {
+		if category != "" {
+			text += "##### " + category + "\n"
+		}
+		// I'm using this ridiculous number of non-breaking spaces as a hacky (read: very very hacky) way of making the usage exapmles not wrap at the space inbetween "@holobot" and the command (ex. "time")
+		text += b.Phrase(ctx, reader, "help-columns", strings.Repeat("&nbsp;", 24)) + "\n"
+		text += "|---------|-------------|---|---|\n"
+		for _, cmd := range byCategory[category] {
+			example := ""
+			if len(cmd.Examples) > 0 {
+				example = "*" + cmd.Examples[0] + "*"
+			}
+			text += fmt.Sprintf("| `%s` | %s | `%s` | %s |\n", cmd.Name, cmd.Description, b.UsageLine([]string{cmd.Name}, &cmd), example)
+		}
+		text += "\n"
+	}
+	return text + b.helpMessage("help-outro", data)
+}
+
+// helpMessage renders a part of the help around the table of commands. The
+// table is still worth sending if it can't be rendered.
+func (b *Bot) helpMessage(name string, data *MessageData) string {
+	text, err := b.RenderMessage(name, data)
+	if err != nil {
+		fmt.Printf("couldn't render the %s message: %v\n", name, err)
+	}
+	return text
+}
+
+// CommandHelp renders the detailed help of one (sub)command for whoever reads it
+func (b *Bot) CommandHelp(ctx context.Context, reader string, path []string, cmd *Command) string {
+	text := fmt.Sprintf("#### `%s`\n%s\n\n%s", strings.Join(path, " "), cmd.Description, b.Usage(ctx, reader, path, cmd))
+	text += "\n\n" + b.Phrase(ctx, reader, "help-reply-flags", "")
+	if len(cmd.Examples) > 0 {
+		text += "\n\n" + b.Phrase(ctx, reader, "help-examples", "")
+		for _, ex := range cmd.Examples {
+			text += "\n* *" + ex + "*"
+		}
+	}
+	return text
+}
+
+// HandleHelpCommand replies with the list of commands, or with the details of
+// the command named in its arguments
+func (b *Bot) HandleHelpCommand(inv *Invocation) error {
+	names := inv.ArgList("command")
+	if len(names) == 0 {
+		inv.Reply(b.HelpText(inv.Context(), inv.Post.UserId, inv.recipient()))
+		return nil
+	}
+
+	isAdmin := b.IsAdmin(inv.Context(), inv.Post.UserId)
+	cmd := b.FindCommand(names[0])
+	if cmd == nil || (cmd.Visibility == VisibilityAdmin && !isAdmin) {
+		err := &UnknownCommandError{Name: names[0], Suggestion: b.suggestCommand(names[0], b.VisibleCommands(isAdmin))}
+		inv.Reply(b.ParseErrorText(inv.Context(), inv.recipient(), err))
+		return nil
+	}
+	path := []string{cmd.Name}
+	for _, name := range names[1:] {
+		var sub *Command
+		for i := range cmd.Subcommands {
+			if strings.EqualFold(cmd.Subcommands[i].Name, name) {
+				sub = &cmd.Subcommands[i]
+			}
+		}
+		if sub == nil {
+			break
+		}
+		cmd = sub
+		path = append(path, sub.Name)
+	}
+	inv.Reply(b.CommandHelp(inv.Context(), inv.recipient(), path, cmd))
+	return nil
+}
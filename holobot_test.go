@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"testing"
+)
+
+// testBot is a bot logged in to a FakeServer, with a public team that has
+// ~announcements and ~town-square and a member, alice
+type testBot struct {
+	*Bot
+	s                   *FakeServer
+	alice               *model.User
+	team                *model.Team
+	announcements, town *model.Channel
+}
+
+func newTestBot(t *testing.T) *testBot {
+	s := NewFakeServer()
+	s.AddUser("holobot", "holobot@example.com", "secret")
+	tb := &testBot{s: s, alice: s.AddUser("alice", "alice@example.com", "secret"), team: s.AddTeam("public")}
+	s.JoinTeam(tb.alice.Id, tb.team)
+	tb.announcements = s.AddChannel("announcements", tb.team)
+	tb.town = s.AddChannel("town-square", tb.team)
+
+	cfg := Config{UserEmail: "holobot@example.com", UserPassword: "secret", UserName: "holobot", PublicTeamName: "public"}
+	tb.Bot = NewWithClient(cfg, s, NewMemStore())
+	if err := tb.Login(); err != nil {
+		t.Fatal(err)
+	}
+	tb.publicTeam, tb.announcementsChannel = tb.team, tb.announcements
+	tb.registerCommands()
+	if err := tb.registerModeration(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return tb
+}
+
+// post makes a post as a user and returns the event Mattermost would send for it
+func (tb *testBot) post(user *model.User, channel *model.Channel, msg string) *model.WebSocketEvent {
+	return tb.s.PostedEvent(tb.s.AddPost(&model.Post{UserId: user.Id, ChannelId: channel.Id, Message: msg}))
+}
+
+// dm is the DM channel between a user and the bot
+func (tb *testBot) dm(user *model.User) *model.Channel {
+	channel, _ := tb.s.CreateDirectChannel(user.Id, tb.botUser.Id)
+	return channel
+}
+
+// channel finds a channel on the public team by name
+func (tb *testBot) channel(name string) *model.Channel {
+	return tb.FindChannel(context.Background(), name, tb.team)
+}
+
+// sentTo returns what the bot posted in a channel since the first n posts it made
+func (tb *testBot) sentTo(channel *model.Channel, n int) (msgs []string) {
+	for _, p := range tb.s.Created[n:] {
+		if p.ChannelId == channel.Id {
+			msgs = append(msgs, p.Message)
+		}
+	}
+	return
+}
+
+func TestHandleDMs(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want []string // the start of each DM we get back
+	}{
+		{"help", []string{"Hi, I'm holobot!"}},
+		{"who are you?", []string{"Hi, I'm holobot!"}},
+		{"mattermost tips please", []string{"##### Mattermost Tips"}},
+		{"help, and some tips", []string{"Hi, I'm holobot!", "##### Mattermost Tips"}},
+		{"hello there", nil},
+		{"helpful", nil},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		dm := tb.dm(tb.alice)
+		if err := tb.HandleDMs(context.Background(), tb.post(tb.alice, dm, tt.msg)); err != nil {
+			t.Fatal(err)
+		}
+		got := tb.sentTo(dm, 0)
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %d DMs, want %d", tt.msg, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if !strings.HasPrefix(got[i], tt.want[i]) {
+				t.Errorf("%q: DM %d is %q, want it to start with %q", tt.msg, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	// asking for help anywhere else isn't asking us
+	tb := newTestBot(t)
+	if tb.HandleDMs(context.Background(), tb.post(tb.alice, tb.town, "help")); len(tb.s.Created) != 0 {
+		t.Errorf("answered help in ~town-square")
+	}
+}
+
+func TestHandleReactions(t *testing.T) {
+	tests := []struct {
+		name    string
+		byBot   bool
+		emoji   string
+		deleted bool
+	}{
+		{"x on our post", true, "x", true},
+		{"another emoji on our post", true, "thumbsup", false},
+		{"x on someone else's post", false, "x", false},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		author := tb.alice
+		if tt.byBot {
+			author = tb.botUser
+		}
+		post := tb.s.AddPost(&model.Post{UserId: author.Id, ChannelId: tb.town.Id, Message: "hi"})
+		event := tb.s.ReactionEvent(&model.Reaction{UserId: tb.alice.Id, PostId: post.Id, EmojiName: tt.emoji})
+		if err := tb.HandleReactions(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+		if deleted := len(tb.s.Deleted) == 1 && tb.s.Deleted[0] == post.Id; deleted != tt.deleted {
+			t.Errorf("%s: deleted %v, want %v", tt.name, tb.s.Deleted, tt.deleted)
+		}
+	}
+
+	// a reaction to a post that's already gone is an error, not a panic
+	tb := newTestBot(t)
+	event := tb.s.ReactionEvent(&model.Reaction{UserId: tb.alice.Id, PostId: "gone", EmojiName: "x"})
+	if err := tb.HandleReactions(context.Background(), event); err == nil {
+		t.Errorf("no error for a reaction to a missing post")
+	}
+}
+
+func TestHandleSourceRequests(t *testing.T) {
+	tests := []struct {
+		emoji string
+		sent  bool
+	}{
+		{"u55b6", true},
+		{"thumbsup", false},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+		post := tb.s.AddPost(&model.Post{UserId: bob.Id, ChannelId: tb.town.Id, Message: "**bold**\n_and_ more"})
+		reaction := &model.Reaction{UserId: tb.alice.Id, PostId: post.Id, EmojiName: tt.emoji}
+		if err := tb.HandleSourceRequests(context.Background(), tb.s.ReactionEvent(reaction)); err != nil {
+			t.Fatal(err)
+		}
+		got := tb.sentTo(tb.dm(tb.alice), 0)
+		if !tt.sent {
+			if len(got) != 0 || len(tb.s.DeletedReactions) != 0 {
+				t.Errorf(":%s: sent %q and took away %d reactions", tt.emoji, got, len(tb.s.DeletedReactions))
+			}
+			continue
+		}
+		if len(got) != 1 || !strings.Contains(got[0], "@bob") || !strings.Contains(got[0], "    **bold**\n    _and_ more") {
+			t.Errorf(":%s: sent %q, want the source of bob's post", tt.emoji, got)
+		}
+		if len(tb.s.DeletedReactions) != 1 {
+			t.Errorf(":%s: the reaction was left on the post", tt.emoji)
+		}
+	}
+
+	// other reactions are ignored before looking anything up, and a source
+	// request for a post we can't fetch is an error, not a panic
+	tb := newTestBot(t)
+	tb.s.Failing["GetPost"] = 1
+	other := &model.Reaction{UserId: tb.alice.Id, PostId: "gone", EmojiName: "thumbsup"}
+	if err := tb.HandleSourceRequests(context.Background(), tb.s.ReactionEvent(other)); err != nil {
+		t.Errorf(":thumbsup: got %v", err)
+	}
+	if tb.s.Failing["GetPost"] != 1 {
+		t.Errorf(":thumbsup: fetched the post")
+	}
+	request := &model.Reaction{UserId: tb.alice.Id, PostId: "gone", EmojiName: "u55b6"}
+	if err := tb.HandleSourceRequests(context.Background(), tb.s.ReactionEvent(request)); err == nil {
+		t.Errorf(":u55b6: no error when the post couldn't be fetched")
+	}
+	if got := tb.sentTo(tb.dm(tb.alice), 0); len(got) != 0 {
+		t.Errorf(":u55b6: sent %q", got)
+	}
+}
+
+func TestSendDirectMessage(t *testing.T) {
+	tb := newTestBot(t)
+	if err := tb.SendDirectMessage(context.Background(), tb.alice.Id, "hi alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tb.sentTo(tb.dm(tb.alice), 0); len(got) != 1 || got[0] != "hi alice" {
+		t.Errorf("alice got %q", got)
+	}
+
+	// we don't talk to ourselves
+	n := len(tb.s.Created)
+	if err := tb.SendDirectMessage(context.Background(), tb.botUser.Id, "hi me"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tb.s.Created) != n {
+		t.Errorf("DMed ourselves: %q", tb.s.Created[n].Message)
+	}
+}
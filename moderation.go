@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ModerationRule says what may be posted in some channels. A post that breaks
+// the rule is deleted and its author gets the rule's Message by DM.
+type ModerationRule struct {
+	Name     string
+	Channels []string // "team-name/channel-name", or just "channel-name" on the public team
+
+	AllowUsers []string // usernames who may post anything
+	AllowRoles []string // system or channel roles whose members may post anything, e.g. "system_admin", "channel_admin"
+
+	RequirePattern   string   // posts must match this regular expression
+	PatternHint      string   // says what RequirePattern means: a message in the catalog, e.g. "reason-not-an-announcement", or the text itself
+	MaxLength        int      // posts may be at most this many characters, 0 for no limit
+	AllowedFileTypes []string // extensions of files that may be attached, e.g. ["png", "pdf"]; ["none"] allows none, empty allows any
+
+	// Shadow only records what the rule would delete, to try it out before enforcing it
+	Shadow bool
+
+	// GracePeriod, e.g. "15m", gives authors that long to move, mark or delete
+	// their post themselves before it is deleted. Empty deletes posts right away.
+	GracePeriod string
+	MoveTo      string // where authors can move their posts, "channel-name" on the same team or "team-name/channel-name", default "town-square"
+	MarkTag     string // what authors can add to their post to make it follow the rule, e.g. "#announcement"
+
+	// RelocateReplies moves replies that break the rule, instead of deleting
+	// them, into a thread in MoveTo that quotes the post they replied to
+	RelocateReplies bool
+
+	// Message is a text/template for the DM sent when a post is deleted. It can
+	// use {{.User}}, {{.Channel}}, {{.Team}}, {{.Rule}}, {{.Reason}},
+	// {{.Message}}, {{.Quoted}} (the message indented as a code block) and
+	// {{.Count}} (how many of their posts were deleted within ViolationWindow).
+	Message string
+	// Template names a message in the message catalog to send instead of Message
+	Template string
+	// ReminderMessage is the shorter template sent instead of Message from the
+	// second deleted post within ViolationWindow on
+	ReminderMessage string
+
+	// repeat offenders: deleted posts are counted per user over ViolationWindow
+	// (default "168h"). At NotifyAfter the users in Notify ("stewards" for the
+	// ones named after "?:" in the channel header, "admins" for Admins, or
+	// usernames; default both) are told, and at MuteAfter the user can't post
+	// in the channel for MuteFor (default "24h"). 0 turns either off.
+	ViolationWindow string
+	NotifyAfter     int
+	Notify          []string
+	MuteAfter       int
+	MuteFor         string
+}
+
+// ModerationFacts is what the rules need to know about a post
+type ModerationFacts struct {
+	Post     *model.Post
+	Username string
+	Roles    []string
+	Files    []*model.FileInfo
+}
+
+// Violation is why a post breaks a rule. Key names the message in the catalog
+// that says so, e.g. "reason-too-long", and Value is what it's about. A rule's
+// own PatternHint is its Key, and is used as it is unless the catalog has a
+// message by that name.
+type Violation struct {
+	Key, Value string
+}
+
+const announcementPattern = `@channel|@all|@here|#announcement`
+
+// moderationRules returns the configured rules, or the one we've always had:
+// only announcements in ~announcements on the public team
+func (cfg *Config) moderationRules() []ModerationRule {
+	if len(cfg.ModerationRules) > 0 {
+		return cfg.ModerationRules
+	}
+	return []ModerationRule{{
+		Name:            "announcements",
+		Channels:        []string{cfg.PublicTeamName + "/announcements"},
+		RequirePattern:  announcementPattern,
+		PatternHint:     "reason-not-an-announcement",
+		MarkTag:         "#announcement",
+		RelocateReplies: true,
+		Template:        "announcement-deleted",
+	}}
+}
+
+// validate returns what's wrong with the rule, if anything
+func (r *ModerationRule) validate() (problems []string) {
+	if len(r.Channels) == 0 {
+		problems = append(problems, fmt.Sprintf("rule %q doesn't name any Channels", r.Name))
+	}
+	if _, err := regexp.Compile(r.RequirePattern); err != nil {
+		problems = append(problems, fmt.Sprintf("rule %q has a bad RequirePattern: %v", r.Name, err))
+	}
+	if r.GracePeriod != "" {
+		if d, err := time.ParseDuration(r.GracePeriod); err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("rule %q has a bad GracePeriod, it should be a duration like \"15m\"", r.Name))
+		}
+	}
+	if r.MaxLength < 0 {
+		problems = append(problems, fmt.Sprintf("rule %q has a negative MaxLength", r.Name))
+	}
+	if _, err := template.New(r.Name).Funcs(messageFuncs).Parse(r.Message); err != nil {
+		problems = append(problems, fmt.Sprintf("rule %q has a bad Message template: %v", r.Name, err))
+	}
+	if _, err := template.New(r.Name).Funcs(messageFuncs).Parse(r.ReminderMessage); err != nil {
+		problems = append(problems, fmt.Sprintf("rule %q has a bad ReminderMessage template: %v", r.Name, err))
+	}
+	for field, value := range map[string]string{"ViolationWindow": r.ViolationWindow, "MuteFor": r.MuteFor} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("rule %q has a bad %s, it should be a duration like \"24h\"", r.Name, field))
+		}
+	}
+	if r.NotifyAfter < 0 || r.MuteAfter < 0 {
+		problems = append(problems, fmt.Sprintf("rule %q has a negative NotifyAfter or MuteAfter", r.Name))
+	}
+	return
+}
+
+func (r *ModerationRule) needsRoles() bool {
+	return len(r.AllowRoles) > 0
+}
+
+func (r *ModerationRule) needsFiles() bool {
+	return len(r.AllowedFileTypes) > 0
+}
+
+// Check returns why a post breaks the rule, or nil if it doesn't
+func (r *ModerationRule) Check(f ModerationFacts) *Violation {
+	for _, name := range r.AllowUsers {
+		if strings.EqualFold(strings.TrimPrefix(name, "@"), f.Username) {
+			return nil
+		}
+	}
+	for _, allowed := range r.AllowRoles {
+		for _, role := range f.Roles {
+			if role == allowed {
+				return nil
+			}
+		}
+	}
+
+	if r.RequirePattern != "" {
+		if matched, _ := regexp.MatchString(r.RequirePattern, f.Post.Message); !matched {
+			if r.PatternHint != "" {
+				return &Violation{Key: r.PatternHint}
+			}
+			return &Violation{Key: "reason-pattern", Value: r.RequirePattern}
+		}
+	}
+	if r.MaxLength > 0 && len([]rune(f.Post.Message)) > r.MaxLength {
+		return &Violation{Key: "reason-too-long", Value: strconv.Itoa(r.MaxLength)}
+	}
+	if r.needsFiles() {
+		for _, file := range f.Files {
+			if !r.allowsFile(file) {
+				return &Violation{Key: "reason-file-type", Value: file.Name}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ModerationRule) allowsFile(file *model.FileInfo) bool {
+	ext := strings.ToLower(strings.TrimPrefix(file.Extension, "."))
+	if ext == "" {
+		ext = strings.ToLower(strings.TrimPrefix(filepath.Ext(file.Name), "."))
+	}
+	for _, allowed := range r.AllowedFileTypes {
+		if strings.ToLower(strings.TrimPrefix(allowed, ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// registerModeration looks up the channels the rules name. Channels that can't
+// be found are reported and skipped, the rest are moderated anyway.
+func (b *Bot) registerModeration(ctx context.Context) error {
+	moderated := make(map[string][]ModerationRule)
+	var channels []*model.Channel
+	var missing []string
+	for _, rule := range b.cfg().moderationRules() {
+		for _, ref := range rule.Channels {
+			channel := b.FindChannelRef(ctx, ref)
+			if channel == nil {
+				missing = append(missing, ref)
+				continue
+			}
+			if moderated[channel.Id] == nil {
+				channels = append(channels, channel)
+			}
+			moderated[channel.Id] = append(moderated[channel.Id], rule)
+		}
+	}
+
+	b.lk.Lock()
+	b.moderated = moderated
+	b.moderatedChannels = channels
+	b.lk.Unlock()
+
+	if len(missing) > 0 {
+		err := fmt.Errorf("couldn't find the moderated channels %s", strings.Join(missing, ", "))
+		fmt.Println(err)
+		b.SendMsgToDebuggingChannel("**"+err.Error()+"**, they won't be moderated", "")
+		return err
+	}
+	return nil
+}
+
+// ModerationRules returns the rules for a channel
+func (b *Bot) ModerationRules(channelId string) []ModerationRule {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.moderated[channelId]
+}
+
+// moderationFacts gathers what the rules need to know about a post, only
+// asking the server for what some rule actually uses
+func (b *Bot) moderationFacts(ctx context.Context, post *model.Post, sender string, rules []ModerationRule) ModerationFacts {
+	f := ModerationFacts{Post: post, Username: sender}
+	var roles, files bool
+	for i := range rules {
+		roles = roles || rules[i].needsRoles()
+		files = files || rules[i].needsFiles()
+	}
+	if roles {
+		if user, resp := b.api(ctx).GetUser(post.UserId, ""); resp.Error == nil {
+			f.Roles = append(f.Roles, strings.Fields(user.Roles)...)
+		}
+		if member, resp := b.api(ctx).GetChannelMember(post.ChannelId, post.UserId, ""); resp.Error == nil {
+			f.Roles = append(f.Roles, strings.Fields(member.Roles)...)
+		}
+	}
+	if files && len(post.FileIds) > 0 {
+		if infos, resp := b.api(ctx).GetFileInfosForPost(post.Id, ""); resp.Error == nil {
+			f.Files = infos
+		} else {
+			PrintError(resp.Error)
+		}
+	}
+	return f
+}
+
+// ModerationMessage renders the DM telling the author why their post was
+// deleted, a shorter one if it isn't the first time lately
+func (b *Bot) ModerationMessage(ctx context.Context, rule *ModerationRule, post *model.Post, sender string, v *Violation, count int) (string, error) {
+	data := b.messageData(ctx, post.UserId)
+	data.User, data.Rule, data.Reason, data.Message, data.Quoted, data.Count = sender, rule.Name, b.ReasonText(ctx, post.UserId, v), post.Message, quote(post.Message), count
+	if channel, resp := b.api(ctx).GetChannel(post.ChannelId, ""); resp.Error == nil {
+		data.Channel = channel.Name
+		if team, resp := b.api(ctx).GetTeam(channel.TeamId, ""); resp.Error == nil {
+			data.Team = team.Name
+			data.channels = func() []string { return b.PublicChannels(ctx, team.Id) }
+		}
+	}
+
+	text := rule.Message
+	switch {
+	case count > 1 && rule.ReminderMessage == "":
+		return b.RenderMessage("post-deleted-reminder", data)
+	case count > 1:
+		text = rule.ReminderMessage
+	case rule.Template != "":
+		return b.RenderMessage(rule.Template, data)
+	case text == "":
+		return b.RenderMessage("post-deleted", data)
+	}
+	tmpl, err := template.New(rule.Name).Funcs(messageFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ReasonText says why a post broke a rule, for a user or, for "", in the
+// default locale as the audit log and the debugging channel have it
+func (b *Bot) ReasonText(ctx context.Context, userId string, v *Violation) string {
+	if c, err := b.messages(); err != nil || !c.Has(v.Key) {
+		return v.Key
+	}
+	return b.Phrase(ctx, userId, v.Key, v.Value)
+}
+
+// postAudit is an audit log entry about a post that broke a rule
+func (b *Bot) postAudit(ctx context.Context, action string, post *model.Post, sender string, rule *ModerationRule, detail string) AuditEntry {
+	return AuditEntry{Action: action, PostId: post.Id, UserId: post.UserId, Username: sender,
+		ChannelId: post.ChannelId, Channel: b.ChannelName(ctx, post.ChannelId), Rule: rule.Name, Detail: detail}
+}
+
+// HandleModeration deletes posts in moderated channels that break one of the
+// channel's rules, and tells their authors why
+func (b *Bot) HandleModeration(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	rules := b.ModerationRules(event.Broadcast.ChannelId)
+	if len(rules) == 0 {
+		return
+	}
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	sender, _ := event.Data["sender_name"].(string)
+	sender = strings.TrimPrefix(sender, "@")
+	isJoinLeave := b.IsJoinLeave(sender, post)
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("**Running tests on a new post in a moderated channel.**\n**Post:** %v\n**Sender:** %v", post.Message, sender), "")
+
+	// what holobot says goes, except for join/leave noise
+	if post.UserId == b.botUser.Id && !isJoinLeave {
+		b.SendMsgToDebuggingChannel("* **It's a non-join/leave message from holobot! I stopped caring if it follows the rules!**", "")
+		return
+	}
+
+	facts := b.moderationFacts(ctx, post, sender, rules)
+	for i := range rules {
+		rule := &rules[i]
+		v := rule.Check(facts)
+		if v == nil {
+			continue
+		}
+		reason := b.ReasonText(ctx, "", v)
+
+		if b.InShadowMode(rule, post.ChannelId) {
+			d := ShadowDecision{At: model.GetMillis(), ChannelId: post.ChannelId, Channel: b.ChannelName(ctx, post.ChannelId), PostId: post.Id,
+				UserId: post.UserId, Username: sender, Rule: rule.Name, Reason: reason, Message: post.Message}
+			b.Audit(b.postAudit(ctx, AuditWouldDelete, post, sender, rule, reason))
+			// a rule being tried out mustn't stop the others from being enforced
+			if err := b.RecordShadowDecision(d); err != nil {
+				fmt.Printf("couldn't record what rule %s would have done: %v\n", rule.Name, err)
+			}
+			continue
+		}
+
+		if rule.RelocateReplies && post.RootId != "" && !isJoinLeave {
+			link, target, err := b.RelocateReply(ctx, rule, post, sender, "")
+			if err == nil {
+				e := b.postAudit(ctx, AuditSendDM, post, sender, rule, "told them where their reply went")
+				msg := b.Say(ctx, post.UserId, "reply-moved", func(d *MessageData) { d.Channel, d.Link, d.Target = e.Channel, link, target.Name })
+				e.Outcome = outcome(b.SendDirectMessage(ctx, post.UserId, msg))
+				b.Audit(e)
+				return nil
+			}
+			// fall back to deleting it
+			fmt.Printf("couldn't move a reply to the discussion: %v\n", err)
+		}
+
+		if rule.gracePeriod() > 0 && !isJoinLeave {
+			return b.StartGracePeriod(ctx, rule, post, sender, v)
+		}
+
+		_, resp := b.api(ctx).DeletePost(post.Id)
+		e := b.postAudit(ctx, AuditDeletePost, post, sender, rule, reason)
+		e.Outcome = outcome(resp.Error)
+		b.Audit(e)
+		if resp.Error != nil {
+			PrintError(resp.Error)
+			return resp.Error
+		}
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("* **It breaks the rule _%s_ because %s! Deleted!**", rule.Name, reason), "")
+
+		// (sending fails due to a check inside SendDirectMessage if the recipient is holobot.)
+		if isJoinLeave {
+			b.SendMsgToDebuggingChannel("* **That post was also a join/leave message. No DM sent!**", "")
+			return
+		}
+		count := b.RecordViolation(rule, post.UserId)
+		msg, err := b.ModerationMessage(ctx, rule, post, sender, v, count)
+		if err != nil {
+			fmt.Printf("couldn't render the message of rule %s: %v\n", rule.Name, err)
+			return err
+		}
+		e = b.postAudit(ctx, AuditSendDM, post, sender, rule, "told them why it was deleted")
+		e.Outcome = outcome(b.SendDirectMessage(ctx, post.UserId, msg))
+		b.Audit(e)
+		b.Escalate(ctx, rule, post, sender, v, count)
+		return nil
+	}
+	b.SendMsgToDebuggingChannel("* **It follows the rules!**", "")
+	return
+}
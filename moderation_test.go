@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"testing"
+)
+
+func TestHandleModeration(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		deleted bool
+		dm      string // in the DM the author gets
+	}{
+		{"an announcement", "@channel the new release is out", false, ""},
+		{"chatter", "anyone up for lunch?", true, "anyone up for lunch?"},
+		{"a join message", "alice has joined the channel.", true, ""},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		if err := tb.HandleModeration(context.Background(), tb.post(tb.alice, tb.announcements, tt.msg)); err != nil {
+			t.Fatal(err)
+		}
+		if deleted := len(tb.s.Deleted) == 1; deleted != tt.deleted {
+			t.Errorf("%s: deleted %v, want %v", tt.name, tb.s.Deleted, tt.deleted)
+		}
+		got := tb.sentTo(tb.dm(tb.alice), 0)
+		if tt.dm == "" && len(got) > 0 || tt.dm != "" && (len(got) != 1 || !strings.Contains(got[0], tt.dm)) {
+			t.Errorf("%s: got the DMs %q", tt.name, got)
+		}
+	}
+
+	// other channels aren't moderated
+	tb := newTestBot(t)
+	tb.HandleModeration(context.Background(), tb.post(tb.alice, tb.town, "anyone up for lunch?"))
+	if len(tb.s.Deleted) != 0 {
+		t.Errorf("deleted a post in ~town-square")
+	}
+}
+
+func TestHandleModerationRelocatesReplies(t *testing.T) {
+	tb := newTestBot(t)
+	bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+	root := tb.s.AddPost(&model.Post{UserId: bob.Id, ChannelId: tb.announcements.Id, Message: "@channel big news"})
+	for _, user := range []*model.User{tb.alice, bob} {
+		reply := tb.s.AddPost(&model.Post{UserId: user.Id, ChannelId: tb.announcements.Id, RootId: root.Id, Message: "congrats!"})
+		if err := tb.HandleModeration(context.Background(), tb.s.PostedEvent(reply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one thread in ~town-square about the post, with both replies in it
+	posts := tb.s.PostsInChannel(tb.town.Id)
+	if len(posts) != 3 || posts[0].RootId != "" || posts[1].RootId != posts[0].Id || posts[2].RootId != posts[0].Id {
+		t.Fatalf("got %d posts in ~town-square, want a thread of 3", len(posts))
+	}
+	if !strings.Contains(posts[0].Message, "/pl/"+root.Id) || !strings.Contains(posts[1].Message, "@alice") {
+		t.Errorf("got the thread %q, %q", posts[0].Message, posts[1].Message)
+	}
+	if len(tb.s.Deleted) != 2 || len(tb.s.PostsInChannel(tb.announcements.Id)) != 1 {
+		t.Errorf("deleted %v, want the replies", tb.s.Deleted)
+	}
+	if got := tb.sentTo(tb.dm(tb.alice), 0); len(got) != 1 || !strings.Contains(got[0], "~town-square") {
+		t.Errorf("alice got the DMs %q", got)
+	}
+}
+
+func TestRuleCheck(t *testing.T) {
+	png := &model.FileInfo{Name: "cat.png", Extension: "png"}
+	exe := &model.FileInfo{Name: "setup.exe", Extension: "exe"}
+	pattern := ModerationRule{RequirePattern: announcementPattern}
+	tests := []struct {
+		name  string
+		rule  ModerationRule
+		facts ModerationFacts
+		want  *Violation
+	}{
+		{"no conditions", ModerationRule{}, ModerationFacts{}, nil},
+		{"matches the pattern", pattern, ModerationFacts{Post: &model.Post{Message: "@here hi"}}, nil},
+		{"doesn't match the pattern", pattern, ModerationFacts{Post: &model.Post{Message: "hi"}},
+			&Violation{Key: "reason-pattern", Value: announcementPattern}},
+		{"doesn't match the pattern, with a hint", ModerationRule{RequirePattern: "x", PatternHint: "reason-not-an-announcement"},
+			ModerationFacts{Post: &model.Post{Message: "hi"}}, &Violation{Key: "reason-not-an-announcement"}},
+		{"an allowed user", ModerationRule{RequirePattern: "x", AllowUsers: []string{"@Alice"}},
+			ModerationFacts{Post: &model.Post{Message: "hi"}, Username: "alice"}, nil},
+		{"another user", ModerationRule{RequirePattern: "x", AllowUsers: []string{"bob"}},
+			ModerationFacts{Post: &model.Post{Message: "hi"}, Username: "alice"}, &Violation{Key: "reason-pattern", Value: "x"}},
+		{"an allowed role", ModerationRule{RequirePattern: "x", AllowRoles: []string{"channel_admin"}},
+			ModerationFacts{Post: &model.Post{Message: "hi"}, Roles: []string{"system_user", "channel_admin"}}, nil},
+		{"another role", ModerationRule{RequirePattern: "x", AllowRoles: []string{"system_admin"}},
+			ModerationFacts{Post: &model.Post{Message: "hi"}, Roles: []string{"system_user"}}, &Violation{Key: "reason-pattern", Value: "x"}},
+		{"short enough", ModerationRule{MaxLength: 5}, ModerationFacts{Post: &model.Post{Message: "héllo"}}, nil},
+		{"too long", ModerationRule{MaxLength: 5}, ModerationFacts{Post: &model.Post{Message: "héllo!"}},
+			&Violation{Key: "reason-too-long", Value: "5"}},
+		{"an allowed file", ModerationRule{AllowedFileTypes: []string{".PNG"}},
+			ModerationFacts{Post: &model.Post{}, Files: []*model.FileInfo{png}}, nil},
+		{"a file that isn't allowed", ModerationRule{AllowedFileTypes: []string{"png"}},
+			ModerationFacts{Post: &model.Post{}, Files: []*model.FileInfo{png, exe}}, &Violation{Key: "reason-file-type", Value: "setup.exe"}},
+		{"a file by its name", ModerationRule{AllowedFileTypes: []string{"png"}},
+			ModerationFacts{Post: &model.Post{}, Files: []*model.FileInfo{{Name: "dog.png"}}}, nil},
+		{"no files allowed", ModerationRule{AllowedFileTypes: []string{"none"}},
+			ModerationFacts{Post: &model.Post{}, Files: []*model.FileInfo{png}}, &Violation{Key: "reason-file-type", Value: "cat.png"}},
+		{"no files allowed, and none attached", ModerationRule{AllowedFileTypes: []string{"none"}}, ModerationFacts{Post: &model.Post{}}, nil},
+		{"the pattern comes first", ModerationRule{RequirePattern: "x", MaxLength: 1}, ModerationFacts{Post: &model.Post{Message: "hi"}},
+			&Violation{Key: "reason-pattern", Value: "x"}},
+	}
+	for _, tt := range tests {
+		got := tt.rule.Check(tt.facts)
+		if got == nil && tt.want != nil || got != nil && (tt.want == nil || *got != *tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestModerationFacts(t *testing.T) {
+	tb := newTestBot(t)
+	tb.s.Users[tb.alice.Id].Roles = "system_user system_admin"
+	tb.s.MakeChannelAdmin(tb.announcements.Id, tb.alice.Id)
+	post := tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.announcements.Id, Message: "hi", FileIds: []string{"f1"}})
+	tb.s.Files[post.Id] = []*model.FileInfo{{Name: "cat.png", Extension: "png"}}
+
+	roles := ModerationRule{AllowRoles: []string{"system_admin"}}
+	files := ModerationRule{AllowedFileTypes: []string{"png"}}
+	tests := []struct {
+		name         string
+		rules        []ModerationRule
+		roles, files int
+	}{
+		{"a rule that needs neither", []ModerationRule{{RequirePattern: "x"}}, 0, 0},
+		{"a rule that needs roles", []ModerationRule{roles}, 4, 0},
+		{"a rule that needs files", []ModerationRule{files}, 0, 1},
+		{"rules that need both", []ModerationRule{{MaxLength: 10}, roles, files}, 4, 1},
+	}
+	for _, tt := range tests {
+		f := tb.moderationFacts(context.Background(), post, "alice", tt.rules)
+		if f.Post != post || f.Username != "alice" || len(f.Roles) != tt.roles || len(f.Files) != tt.files {
+			t.Errorf("%s: got the roles %v and %d files, want %d and %d", tt.name, f.Roles, len(f.Files), tt.roles, tt.files)
+		}
+	}
+
+	// a post without attachments doesn't need asking about them
+	tb.s.Files[post.Id] = nil
+	post = tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.announcements.Id, Message: "hi"})
+	tb.s.Files[post.Id] = []*model.FileInfo{{Name: "stale.png"}}
+	if f := tb.moderationFacts(context.Background(), post, "alice", []ModerationRule{files}); len(f.Files) != 0 {
+		t.Errorf("got the files %v of a post without any", f.Files)
+	}
+}
+
+func TestModerationRulesByChannel(t *testing.T) {
+	tb := newTestBot(t)
+	staff := tb.s.AddTeam("staff")
+	staffAnnouncements := tb.s.AddChannel("announcements", staff)
+	tb.config.ModerationRules = []ModerationRule{
+		{Name: "announcements", Channels: []string{"announcements", "staff/announcements"}, RequirePattern: announcementPattern},
+		{Name: "short", Channels: []string{"~announcements", "town-square"}, MaxLength: 12},
+	}
+	if err := tb.registerModeration(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		channel *model.Channel
+		rules   []string
+	}{
+		{tb.announcements, []string{"announcements", "short"}},
+		{staffAnnouncements, []string{"announcements"}},
+		{tb.town, []string{"short"}},
+		{tb.dm(tb.alice), nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range tb.ModerationRules(tt.channel.Id) {
+			got = append(got, r.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.rules, ",") {
+			t.Errorf("%s: got the rules %v, want %v", tt.channel.Name, got, tt.rules)
+		}
+	}
+
+	// each of a channel's rules is applied
+	posts := []struct {
+		channel *model.Channel
+		msg     string
+		deleted bool
+	}{
+		{tb.announcements, "@channel hi", false},
+		{tb.announcements, "@channel hello everyone", true},
+		{tb.announcements, "hi", true},
+		{staffAnnouncements, "@channel hello everyone", false},
+		{tb.town, "hello everyone", true},
+		{tb.town, "hi", false},
+	}
+	for _, p := range posts {
+		n := len(tb.s.Deleted)
+		if err := tb.HandleModeration(context.Background(), tb.post(tb.alice, p.channel, p.msg)); err != nil {
+			t.Fatal(err)
+		}
+		if deleted := len(tb.s.Deleted) > n; deleted != p.deleted {
+			t.Errorf("%q in %s: deleted %v, want %v", p.msg, p.channel.Name, deleted, p.deleted)
+		}
+	}
+
+	// channels that can't be found are skipped, the rest still moderated
+	tb.config.ModerationRules = append(tb.config.ModerationRules, ModerationRule{Name: "gone", Channels: []string{"nope", "staff/nope"}})
+	if err := tb.registerModeration(context.Background()); err == nil || !strings.Contains(err.Error(), "nope, staff/nope") {
+		t.Errorf("got %v, want the missing channels", err)
+	}
+	if len(tb.ModerationRules(tb.town.Id)) != 1 {
+		t.Errorf("~town-square isn't moderated once a channel is missing")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// when each user's posts were deleted for breaking a rule, keyed by "<rule>:<user id>"
+	violationsNamespace = "violations"
+	// users who may not post in a channel for a while, keyed by "<channel id>:<user id>"
+	mutesNamespace = "mutes"
+
+	defaultViolationWindow = 7 * 24 * time.Hour
+	defaultMuteFor         = 24 * time.Hour
+
+	// giving someone their posting rights back is retried with a doubling
+	// delay, starting at unmuteRetryDelay, up to maxUnmuteAttempts times
+	unmuteRetryDelay  = 15 * time.Second
+	maxUnmuteAttempts = 8
+)
+
+// the stewards of a channel are the users mentioned after "?:" in its header
+var stewardsRe = regexp.MustCompile(`\?:((?:\s*,?\s*@[\w.-]+)+)`)
+
+// Violations are the times a user's posts were deleted for breaking a rule
+type Violations struct {
+	Times []int64 // millis, oldest first
+}
+
+// Mute is a user who may not post in a channel until Until. They stay in the
+// channel and can still read it.
+type Mute struct {
+	ChannelId string
+	UserId    string
+	Username  string
+	Rule      string
+	Until     int64 // millis
+	WasAdmin  bool  // they were a channel admin, which they get back too
+
+	Attempts int   `json:",omitempty"` // failed tries to unmute them
+	RetryAt  int64 `json:",omitempty"` // millis, when to try again
+}
+
+func (r *ModerationRule) violationWindow() time.Duration {
+	if d, err := time.ParseDuration(r.ViolationWindow); err == nil && d > 0 {
+		return d
+	}
+	return defaultViolationWindow
+}
+
+func (r *ModerationRule) muteFor() time.Duration {
+	if d, err := time.ParseDuration(r.MuteFor); err == nil && d > 0 {
+		return d
+	}
+	return defaultMuteFor
+}
+
+// RecordViolation remembers that a user's post was deleted for breaking a rule
+// and returns how many times that happened within the rule's ViolationWindow
+func (b *Bot) RecordViolation(rule *ModerationRule, userId string) int {
+	key := rule.Name + ":" + userId
+	var v Violations
+	if _, err := b.store.Get(violationsNamespace, key, &v); err != nil {
+		fmt.Printf("error reading the violations of %s: %v\n", key, err)
+	}
+	now := model.GetMillis()
+	cutoff := now - int64(rule.violationWindow()/time.Millisecond)
+	var recent []int64
+	for _, t := range v.Times {
+		if t >= cutoff {
+			recent = append(recent, t)
+		}
+	}
+	v.Times = append(recent, now)
+	if err := b.store.Put(violationsNamespace, key, v); err != nil {
+		fmt.Printf("couldn't record a violation of %s: %v\n", key, err)
+	}
+	return len(v.Times)
+}
+
+// Stewards returns the users to tell about repeat offenders in a channel: the
+// rule's Notify list, where "stewards" stands for the users named after "?:" in
+// the channel header and "admins" for the configured Admins
+func (b *Bot) Stewards(rule *ModerationRule, channel *model.Channel) (usernames []string) {
+	notify := rule.Notify
+	if len(notify) == 0 {
+		notify = []string{"stewards", "admins"}
+	}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			usernames = append(usernames, name)
+		}
+	}
+	for _, n := range notify {
+		switch strings.ToLower(n) {
+		case "stewards":
+			if m := stewardsRe.FindStringSubmatch(channel.Header); m != nil {
+				for _, name := range strings.FieldsFunc(m[1], func(r rune) bool { return r == ',' || r == ' ' }) {
+					add(name)
+				}
+			}
+		case "admins":
+			for _, name := range b.cfg().Admins {
+				add(name)
+			}
+		default:
+			add(n)
+		}
+	}
+	return
+}
+
+// Escalate deals with a user whose post was just deleted for the count-th time:
+// their stewards hear about it at NotifyAfter, and at MuteAfter they can't post
+// in the channel for MuteFor
+func (b *Bot) Escalate(ctx context.Context, rule *ModerationRule, post *model.Post, sender string, v *Violation, count int) {
+	if rule.NotifyAfter <= 0 && rule.MuteAfter <= 0 {
+		return
+	}
+	channel, resp := b.api(ctx).GetChannel(post.ChannelId, "")
+	if resp.Error != nil {
+		PrintError(resp.Error)
+		return
+	}
+	muted := rule.MuteAfter > 0 && count >= rule.MuteAfter && b.Mute(ctx, rule, channel, post.UserId, sender)
+	if !muted && (rule.NotifyAfter <= 0 || count != rule.NotifyAfter) {
+		return
+	}
+
+	// each steward is told in their own language
+	message := func(userId string) string {
+		msg := b.Say(ctx, userId, "repeat-offender", func(d *MessageData) {
+			d.Count, d.Author, d.Channel, d.Value = count, sender, channel.Name, rule.violationWindow().String()
+			d.Rule, d.Reason = rule.Name, b.ReasonText(ctx, userId, v)
+		})
+		if muted {
+			msg += " " + b.Say(ctx, userId, "repeat-offender-muted", func(d *MessageData) { d.Channel, d.Value = channel.Name, rule.muteFor().String() })
+		}
+		return msg
+	}
+	stewards := b.Stewards(rule, channel)
+	if len(stewards) == 0 {
+		b.SendMsgToDebuggingChannel(message(""), "")
+		return
+	}
+	for _, name := range stewards {
+		user, resp := b.api(ctx).GetUserByUsername(name, "")
+		if resp.Error != nil {
+			fmt.Printf("couldn't find the steward @%s: %v\n", name, resp.Error.Message)
+			continue
+		}
+		err := b.SendDirectMessage(ctx, user.Id, message(user.Id))
+		b.Audit(AuditEntry{Action: AuditNotify, UserId: post.UserId, Username: sender, ChannelId: channel.Id, Channel: channel.Name,
+			Rule: rule.Name, Detail: fmt.Sprintf("told @%s about %d violations", name, count), Outcome: outcome(err)})
+	}
+}
+
+// Mute takes away a user's posting rights in a channel for the rule's MuteFor,
+// by taking the channel_user role (and channel_admin) off their membership, and
+// reports whether it did. Users who are already muted there aren't muted again.
+func (b *Bot) Mute(ctx context.Context, rule *ModerationRule, channel *model.Channel, userId, username string) bool {
+	key := channel.Id + ":" + userId
+	if found, _ := b.store.Get(mutesNamespace, key, &Mute{}); found {
+		return false
+	}
+	member, resp := b.api(ctx).GetChannelMember(channel.Id, userId, "")
+	var err error
+	if resp.Error != nil {
+		err = resp.Error
+	} else {
+		m := Mute{ChannelId: channel.Id, UserId: userId, Username: username, Rule: rule.Name,
+			Until: model.GetMillis() + int64(rule.muteFor()/time.Millisecond), WasAdmin: member.SchemeAdmin}
+		// remembered first, so RestoreMutes always knows who to let post again
+		if err = b.store.Put(mutesNamespace, key, m); err == nil {
+			if _, resp = b.api(ctx).UpdateChannelMemberSchemeRoles(channel.Id, userId, &model.SchemeRoles{SchemeUser: false, SchemeAdmin: false}); resp.Error != nil {
+				err = resp.Error
+				b.store.Delete(mutesNamespace, key)
+			}
+		}
+	}
+	b.Audit(AuditEntry{Action: AuditMute, UserId: userId, Username: username, ChannelId: channel.Id, Channel: channel.Name,
+		Rule: rule.Name, Detail: fmt.Sprintf("muted for %v", rule.muteFor()), Outcome: outcome(err)})
+	if err != nil {
+		fmt.Printf("couldn't mute %s: %v\n", key, err)
+		return false
+	}
+	b.SendDirectMessage(ctx, userId, b.Say(ctx, userId, "muted", func(d *MessageData) { d.Channel, d.Value = channel.Name, rule.muteFor().String() }))
+	return true
+}
+
+// Mutes returns the users who currently can't post in channels, soonest back first
+func (b *Bot) Mutes() (mutes []Mute, err error) {
+	keys, err := b.store.Keys(mutesNamespace)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var m Mute
+		if _, err = b.store.Get(mutesNamespace, key, &m); err != nil {
+			return
+		}
+		mutes = append(mutes, m)
+	}
+	sort.Slice(mutes, func(i, j int) bool { return mutes[i].Until < mutes[j].Until })
+	return
+}
+
+// Unmute gives a muted user their posting rights back. If that fails it's
+// retried by RestoreMutes with a growing delay, and given up on after
+// maxUnmuteAttempts; only the final outcome goes in the audit log.
+func (b *Bot) Unmute(ctx context.Context, m Mute, actor, why string) error {
+	_, resp := b.api(ctx).UpdateChannelMemberSchemeRoles(m.ChannelId, m.UserId, &model.SchemeRoles{SchemeUser: true, SchemeAdmin: m.WasAdmin})
+	key := m.ChannelId + ":" + m.UserId
+	if resp.Error != nil && resp.StatusCode != http.StatusNotFound {
+		m.Attempts++
+		if m.Attempts < maxUnmuteAttempts {
+			now := model.GetMillis()
+			if m.Attempts == 1 {
+				PrintError(resp.Error)
+			}
+			// it's over either way, it just hasn't worked yet
+			if m.Until > now {
+				m.Until = now
+			}
+			m.RetryAt = now + int64(unmuteRetryDelay<<uint(m.Attempts-1)/time.Millisecond)
+			if err := b.store.Put(mutesNamespace, key, m); err != nil {
+				return err
+			}
+			return resp.Error
+		}
+		fmt.Printf("giving up on unmuting %s in %s: %v\n", m.UserId, m.ChannelId, resp.Error.Message)
+		b.SendMsgToDebuggingChannel(fmt.Sprintf("**I couldn't let @%s post in ~%s again**, please do it by hand: %s", m.Username, b.ChannelName(ctx, m.ChannelId), resp.Error.Message), "")
+	}
+	// someone who left the channel in the meantime has nothing to get back
+	b.Audit(AuditEntry{Actor: actor, Action: AuditUnmute, UserId: m.UserId, Username: m.Username, ChannelId: m.ChannelId,
+		Rule: m.Rule, Detail: why, Outcome: outcome(resp.Error)})
+	if err := b.store.Delete(mutesNamespace, key); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	b.SendDirectMessage(ctx, m.UserId, b.Say(ctx, m.UserId, "unmuted", func(d *MessageData) { d.Channel = b.ChannelName(ctx, m.ChannelId) }))
+	return nil
+}
+
+// RestoreMutes gives users their posting rights back once their time is up
+func (b *Bot) RestoreMutes(ctx context.Context) {
+	mutes, err := b.Mutes()
+	if err != nil {
+		fmt.Printf("couldn't read the mutes: %v\n", err)
+		return
+	}
+	now := model.GetMillis()
+	for _, m := range mutes {
+		if m.Until > now || ctx.Err() != nil {
+			break
+		}
+		if m.RetryAt > now {
+			continue
+		}
+		b.Unmute(ctx, m, "", "mute ended")
+	}
+}
+
+// HandleOffendersCommand lists who broke the rules most lately, and who is muted
+func (b *Bot) HandleOffendersCommand(inv *Invocation) error {
+	keys, err := b.store.Keys(violationsNamespace)
+	if err != nil {
+		inv.Reply(inv.Phrase("offenders-unreadable", ""))
+		return err
+	}
+	type offender struct {
+		rule, userId string
+		count        int
+	}
+	var offenders []offender
+	now := model.GetMillis()
+	for _, key := range keys {
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			continue
+		}
+		var v Violations
+		if _, err = b.store.Get(violationsNamespace, key, &v); err != nil {
+			return err
+		}
+		window := defaultViolationWindow
+		for _, rule := range b.cfg().moderationRules() {
+			if rule.Name == key[:i] {
+				window = rule.violationWindow()
+			}
+		}
+		n := 0
+		for _, t := range v.Times {
+			if t >= now-int64(window/time.Millisecond) {
+				n++
+			}
+		}
+		if n > 0 {
+			offenders = append(offenders, offender{key[:i], key[i+1:], n})
+		}
+	}
+	sort.SliceStable(offenders, func(i, j int) bool { return offenders[i].count > offenders[j].count })
+
+	username := func(userId string) string {
+		if user, resp := b.api(inv.Context()).GetUser(userId, ""); resp.Error == nil {
+			return "@" + user.Username
+		}
+		return userId
+	}
+	text := inv.Phrase("offenders-none", "")
+	if len(offenders) > 0 {
+		text = inv.Phrase("offenders-columns", "") + "\n|---|---|---|"
+		for i, o := range offenders {
+			if i == 20 {
+				break
+			}
+			text += fmt.Sprintf("\n| %s | %s | %d |", username(o.userId), o.rule, o.count)
+		}
+	}
+	mutes, err := b.Mutes()
+	if err != nil {
+		return err
+	}
+	if len(mutes) > 0 {
+		text += "\n\n" + inv.Phrase("offenders-muted", "")
+		for _, m := range mutes {
+			text += "\n* " + inv.Say("offenders-muted-until", func(d *MessageData) {
+				d.Author, d.Channel, d.Rule = m.Username, b.ChannelName(inv.Context(), m.ChannelId), m.Rule
+				d.Value = time.Unix(0, m.Until*int64(time.Millisecond)).UTC().Format("Jan 2 15:04")
+			})
+		}
+	}
+	inv.Reply(text)
+	return nil
+}
+
+// HandleForgiveCommand forgets a user's violations and ends their mutes early
+func (b *Bot) HandleForgiveCommand(inv *Invocation) error {
+	name := strings.TrimPrefix(inv.Arg("user"), "@")
+	user, resp := b.api(inv.Context()).GetUserByUsername(name, "")
+	if resp.Error != nil {
+		inv.Reply(inv.Phrase("unknown-user", name))
+		return nil
+	}
+	keys, err := b.store.Keys(violationsNamespace)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":"+user.Id) {
+			if err = b.store.Delete(violationsNamespace, key); err != nil {
+				return err
+			}
+		}
+	}
+	mutes, err := b.Mutes()
+	if err != nil {
+		return err
+	}
+	for _, m := range mutes {
+		if m.UserId == user.Id {
+			b.Unmute(inv.Context(), m, inv.Sender(), "forgiven")
+		}
+	}
+	inv.Reply(inv.Phrase("forgiven", user.Username))
+	return nil
+}
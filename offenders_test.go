@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// failingStore is a Store whose Puts into one namespace fail
+type failingStore struct {
+	Store
+	namespace string
+}
+
+func (s failingStore) Put(namespace, key string, value interface{}) error {
+	if namespace == s.namespace {
+		return errors.New("disk full")
+	}
+	return s.Store.Put(namespace, key, value)
+}
+
+func TestMute(t *testing.T) {
+	tests := []struct {
+		name         string
+		storeFails   bool
+		serverFails  bool
+		muted, saved bool
+	}{
+		{"muting works", false, false, true, true},
+		{"the mute can't be saved", true, false, false, false},
+		{"the roles can't be changed", false, true, false, false},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		tb.s.AddChannelMember(tb.announcements.Id, tb.alice.Id)
+		if tt.storeFails {
+			tb.store = failingStore{tb.store, mutesNamespace}
+		}
+		if tt.serverFails {
+			tb.s.Failing["UpdateChannelMemberSchemeRoles"] = 1
+		}
+		rule := &ModerationRule{Name: "announcements", MuteAfter: 1}
+		if muted := tb.Mute(context.Background(), rule, tb.announcements, tb.alice.Id, "alice"); muted != tt.muted {
+			t.Errorf("%s: muted is %v, want %v", tt.name, muted, tt.muted)
+		}
+		key := tb.announcements.Id + ":" + tb.alice.Id
+		if saved, _ := tb.store.Get(mutesNamespace, key, &Mute{}); saved != tt.saved {
+			t.Errorf("%s: saved is %v, want %v", tt.name, saved, tt.saved)
+		}
+		// nobody is left unable to post without a mute that gives it back
+		if roles := tb.s.SchemeRoles[key]; (roles != nil && !roles.SchemeUser) != tt.saved {
+			t.Errorf("%s: got the roles %+v", tt.name, roles)
+		}
+	}
+}
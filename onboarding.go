@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// where new members are in their onboarding, by user id
+	onboardingNamespace = "onboarding"
+
+	// how often we look for onboarding steps that are due
+	onboardingCheckInterval = time.Minute
+
+	maxSuggestions = 5
+
+	// how many times a step that couldn't be sent is tried before it's skipped
+	maxOnboardingAttempts = 5
+)
+
+// what a reply to an onboarding step means
+const (
+	ExpectInterests = "interests" // a few words about what they're into, to suggest channels for
+	ExpectFeedback  = "feedback"  // passed on to the admins
+)
+
+// OnboardingStep is a DM new members of the public team get some time after joining
+type OnboardingStep struct {
+	After   string // how long after joining, e.g. "24h"
+	Message string // the message in the catalog to send, which also names the step
+	Expect  string // what a reply means, "interests" or "feedback", empty if nothing
+}
+
+// Journey is where a new member is in their onboarding
+type Journey struct {
+	UserId    string
+	Joined    int64            // millis
+	Sent      map[string]int64 // step -> when it was sent, millis
+	Answered  map[string]bool  // steps they replied to
+	Failed    map[string]int   `json:",omitempty"` // step -> times it couldn't be sent
+	Interests []string
+	Offered   []string // the channels we last suggested, which "join" joins
+	Stopped   bool     // they asked us to stop
+}
+
+var (
+	stopRe = regexp.MustCompile(`(?i)^\s*(stop|unsubscribe)\s*[.!]*\s*$`)
+	// "hosting, app development and rust" -> hosting, app development, rust
+	interestSeparatorRe = regexp.MustCompile(`(?i)\s*(?:[,;/&\n]|\band\b)\s*`)
+	wordRe              = regexp.MustCompile(`[a-z0-9]+`)
+	// "join", "join all", "join ~app-dev ~rust"
+	joinRe = regexp.MustCompile(`(?i)^\s*join\b\s*(.*?)\s*$`)
+	// a DM that only asks for help or the tips
+	justAskingRe = regexp.MustCompile(`(?i)^\W*(?:help|halp|who are you|commands|(?:mattermost\s+)?tips)\W*$`)
+)
+
+// onboardingSteps returns the configured steps, or the ones we have by default:
+// a welcome that asks what they're interested in, channel suggestions after a
+// day, tips after three and a check-in after a week
+func (cfg *Config) onboardingSteps() []OnboardingStep {
+	if len(cfg.Onboarding) > 0 {
+		return cfg.Onboarding
+	}
+	return []OnboardingStep{
+		{After: "0s", Message: "welcome"},
+		{After: "0s", Message: "onboarding-interests", Expect: ExpectInterests},
+		{After: "24h", Message: "onboarding-channels"},
+		{After: "72h", Message: "tips"},
+		{After: "168h", Message: "onboarding-check-in", Expect: ExpectFeedback},
+	}
+}
+
+func (s *OnboardingStep) after() time.Duration {
+	d, _ := time.ParseDuration(s.After)
+	return d
+}
+
+// validateOnboarding returns what's wrong with the steps, if anything
+func validateOnboarding(steps []OnboardingStep) (problems []string) {
+	seen := make(map[string]bool)
+	for _, s := range steps {
+		if s.Message == "" {
+			problems = append(problems, "has a step without a Message")
+			continue
+		}
+		if seen[s.Message] {
+			problems = append(problems, fmt.Sprintf("sends %q twice", s.Message))
+		}
+		seen[s.Message] = true
+		if d, err := time.ParseDuration(s.After); err != nil || d < 0 {
+			problems = append(problems, fmt.Sprintf("step %q has a bad After, it should be a duration like \"24h\"", s.Message))
+		}
+		if s.Expect != "" && s.Expect != ExpectInterests && s.Expect != ExpectFeedback {
+			problems = append(problems, fmt.Sprintf("step %q expects %q, which should be %q or %q", s.Message, s.Expect, ExpectInterests, ExpectFeedback))
+		}
+	}
+	return
+}
+
+// ParseInterests splits a reply like "hosting, app development and rust" into interests
+func ParseInterests(text string) (interests []string) {
+	for _, s := range interestSeparatorRe.Split(strings.ToLower(text), -1) {
+		if s = strings.Trim(s, " \t.!?"); s != "" && len(interests) < 10 {
+			interests = append(interests, s)
+		}
+	}
+	return
+}
+
+// SuggestChannels returns the public channels whose ChannelTags, name, purpose
+// or header mention the interests, best matches first, leaving out the ones the
+// user is already in
+func (b *Bot) SuggestChannels(ctx context.Context, userId string, interests []string) (names []string) {
+	if b.publicTeam == nil || len(interests) == 0 {
+		return
+	}
+	type match struct {
+		id, name string
+		score    int
+	}
+	var matches []match
+	tags := b.cfg().channelTags()
+	for _, c := range b.publicChannels(ctx, b.publicTeam.Id) {
+		words := wordRe.FindAllString(strings.ToLower(c.Name+" "+c.DisplayName+" "+c.Purpose+" "+c.Header+" "+strings.Join(tags[c.Name], " ")), -1)
+		text := " " + strings.Join(words, " ") + " "
+		score := 0
+		for _, interest := range interests {
+			interestWords := wordRe.FindAllString(interest, -1)
+			// the tags say what a channel is about better than its purpose
+			if contains(tags[c.Name], interest) {
+				score += 3
+				continue
+			}
+			if len(interestWords) > 0 && strings.Contains(text, " "+strings.Join(interestWords, " ")+" ") {
+				score += 2
+				continue
+			}
+			// or some of its words, where "dev" is short for "development"
+			for _, w := range interestWords {
+				if matchesWord(w, words) {
+					score++
+				}
+			}
+		}
+		if score > 0 {
+			matches = append(matches, match{c.Id, c.Name, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score > matches[j].score })
+	for _, m := range matches {
+		if len(names) == maxSuggestions {
+			break
+		}
+		if _, resp := b.api(ctx).GetChannelMember(m.id, userId, ""); resp.Error == nil {
+			continue
+		}
+		names = append(names, m.name)
+	}
+	return
+}
+
+// channelTags returns ChannelTags by channel name, without the "~" and lowercased
+func (cfg *Config) channelTags() map[string][]string {
+	tags := make(map[string][]string)
+	for name, list := range cfg.ChannelTags {
+		name = strings.ToLower(strings.TrimPrefix(name, "~"))
+		for _, tag := range list {
+			tags[name] = append(tags[name], strings.ToLower(strings.TrimSpace(tag)))
+		}
+	}
+	return tags
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWord reports whether one of words is w, or starts it, or starts with it
+func matchesWord(w string, words []string) bool {
+	if len(w) < 3 {
+		return false
+	}
+	for _, x := range words {
+		if len(x) >= 3 && (strings.HasPrefix(w, x) || strings.HasPrefix(x, w)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StartOnboarding starts a new member's onboarding and sends the steps that
+// are due right away. Members who already started it aren't started again.
+func (b *Bot) StartOnboarding(ctx context.Context, userId string) error {
+	b.onboarding.Lock()
+	defer b.onboarding.Unlock()
+	if found, err := b.store.Get(onboardingNamespace, userId, &Journey{}); found || err != nil {
+		return err
+	}
+	j := Journey{UserId: userId, Joined: model.GetMillis(), Sent: make(map[string]int64), Answered: make(map[string]bool)}
+	if err := b.store.Put(onboardingNamespace, userId, j); err != nil {
+		fmt.Printf("couldn't start the onboarding of %s: %v\n", userId, err)
+		return err
+	}
+	return b.advanceJourney(ctx, &j)
+}
+
+// advanceJourney sends the steps that are due, in order. A step is marked as
+// sent before it's sent, and unmarked if that fails, so a restart never sends
+// it twice. A step that can't be sent doesn't hold up the ones after it: it's
+// tried again up to maxOnboardingAttempts times, or skipped right away if its
+// message doesn't render. The caller must hold b.onboarding.
+func (b *Bot) advanceJourney(ctx context.Context, j *Journey) error {
+	if j.Stopped {
+		return nil
+	}
+	if j.Sent == nil {
+		j.Sent = make(map[string]int64)
+	}
+	if j.Failed == nil {
+		j.Failed = make(map[string]int)
+	}
+	now := model.GetMillis()
+	for _, step := range b.cfg().onboardingSteps() {
+		if _, sent := j.Sent[step.Message]; sent || j.Joined+int64(step.after()/time.Millisecond) > now {
+			continue
+		}
+		j.Sent[step.Message] = now
+		if err := b.store.Put(onboardingNamespace, j.UserId, j); err != nil {
+			return err
+		}
+		data := b.journeyData(ctx, j)
+		msg, err := b.RenderMessage(step.Message, data)
+		rendered := err == nil
+		if rendered {
+			err = b.SendDirectMessage(ctx, j.UserId, msg)
+		}
+		if err != nil {
+			j.Failed[step.Message]++
+			if rendered && j.Failed[step.Message] < maxOnboardingAttempts {
+				if j.Failed[step.Message] == 1 {
+					fmt.Printf("couldn't send %s the onboarding step %s, trying again later: %v\n", j.UserId, step.Message, err)
+				}
+				// try again next time
+				delete(j.Sent, step.Message)
+			} else {
+				fmt.Printf("skipping the onboarding step %s for %s: %v\n", step.Message, j.UserId, err)
+			}
+		}
+		if err == nil || j.Sent[step.Message] != 0 {
+			b.Audit(AuditEntry{Action: AuditSendDM, UserId: j.UserId, Detail: "onboarding: " + step.Message, Outcome: outcome(err)})
+		}
+		// how it went, and the channels it suggested
+		if err = b.store.Put(onboardingNamespace, j.UserId, j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journeyData is what the onboarding templates get. The channels a message
+// suggests are remembered as the ones "join" joins; the caller saves the journey.
+func (b *Bot) journeyData(ctx context.Context, j *Journey) *MessageData {
+	data := b.messageData(ctx, j.UserId)
+	data.Interests = j.Interests
+	data.suggestions = func() []string {
+		j.Offered = b.SuggestChannels(ctx, j.UserId, j.Interests)
+		return j.Offered
+	}
+	return data
+}
+
+// JoinChannels adds a new member to public channels of the public team on
+// their behalf, given by name or "all" for the ones we suggested. It returns
+// the data for the reply, with the channels they were added to and the ones
+// that couldn't be found.
+func (b *Bot) JoinChannels(ctx context.Context, j *Journey, refs []string) (data *MessageData) {
+	data = b.journeyData(ctx, j)
+	if len(refs) == 0 || len(refs) == 1 && (refs[0] == "all" || refs[0] == "them") {
+		refs = j.Offered
+	}
+	for _, ref := range refs {
+		name := strings.ToLower(strings.TrimPrefix(ref, "~"))
+		channel, resp := b.api(ctx).GetChannelByName(name, b.publicTeam.Id, "")
+		// only what they could have joined themselves
+		if resp.Error != nil || channel.Type != model.CHANNEL_OPEN {
+			data.NotFound = append(data.NotFound, name)
+			continue
+		}
+		_, resp = b.api(ctx).AddChannelMember(channel.Id, j.UserId)
+		b.Audit(AuditEntry{Action: AuditAddMember, UserId: j.UserId, ChannelId: channel.Id, Channel: channel.Name,
+			Detail: "onboarding: asked to join", Outcome: outcome(resp.Error)})
+		if resp.Error != nil {
+			fmt.Printf("couldn't add %s to %s: %v\n", j.UserId, channel.Name, resp.Error.Message)
+			data.NotFound = append(data.NotFound, name)
+			continue
+		}
+		data.Joined = append(data.Joined, channel.Name)
+	}
+	var offered []string
+	for _, name := range j.Offered {
+		if !contains(data.Joined, name) {
+			offered = append(offered, name)
+		}
+	}
+	j.Offered = offered
+	return
+}
+
+// Journeys returns everyone's onboarding
+func (b *Bot) Journeys() (journeys []Journey, err error) {
+	keys, err := b.store.Keys(onboardingNamespace)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		var j Journey
+		if _, err = b.store.Get(onboardingNamespace, key, &j); err != nil {
+			return
+		}
+		journeys = append(journeys, j)
+	}
+	return
+}
+
+// AdvanceOnboarding sends everyone the onboarding steps that are due
+func (b *Bot) AdvanceOnboarding(ctx context.Context) {
+	b.onboarding.Lock()
+	defer b.onboarding.Unlock()
+	journeys, err := b.Journeys()
+	if err != nil {
+		fmt.Printf("couldn't read the onboarding: %v\n", err)
+		return
+	}
+	steps := len(b.cfg().onboardingSteps())
+	for i := range journeys {
+		if ctx.Err() != nil {
+			return
+		}
+		if j := &journeys[i]; !j.Stopped && len(j.Sent) < steps {
+			if err = b.advanceJourney(ctx, j); err != nil {
+				fmt.Printf("couldn't onboard %s: %v\n", j.UserId, err)
+			}
+		}
+	}
+}
+
+// lastStep returns the most recent step a new member got
+func (b *Bot) lastStep(j *Journey) (last *OnboardingStep) {
+	var at int64
+	steps := b.cfg().onboardingSteps()
+	for i := range steps {
+		// steps sent together come in config order
+		if t, sent := j.Sent[steps[i].Message]; sent && t >= at {
+			last, at = &steps[i], t
+		}
+	}
+	return
+}
+
+// onboardingAnswer returns what a DM means to someone's onboarding: "stop",
+// "join", or what the step they last got expects, "" if it isn't about it. Only
+// a DM that just asks for help or tips is left to the other handlers, so an
+// answer like "helping with hosting" is still taken as one.
+func (b *Bot) onboardingAnswer(j *Journey, msg string) string {
+	if j.Stopped || b.CommandLine(msg) != "" || graceReplyRe.MatchString(msg) || justAskingRe.MatchString(msg) {
+		return ""
+	}
+	if stopRe.MatchString(msg) {
+		if len(j.Sent) >= len(b.cfg().onboardingSteps()) {
+			return ""
+		}
+		return "stop"
+	}
+	if joinRe.MatchString(msg) {
+		return "join"
+	}
+	if step := b.lastStep(j); step != nil && !j.Answered[step.Message] {
+		return step.Expect
+	}
+	return ""
+}
+
+// IsOnboardingAnswer reports whether a DM is for HandleOnboardingReplies, so the
+// other DM handlers can leave it alone
+func (b *Bot) IsOnboardingAnswer(userId, msg string) bool {
+	b.onboarding.Lock()
+	defer b.onboarding.Unlock()
+	var j Journey
+	found, err := b.store.Get(onboardingNamespace, userId, &j)
+	return found && err == nil && b.onboardingAnswer(&j, msg) != ""
+}
+
+// HandleOnboardingReplies deals with what new members DM us during their
+// onboarding: "stop", what they're interested in, which channels to join, or
+// how it went
+func (b *Bot) HandleOnboardingReplies(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	name, _ := event.Data["channel_name"].(string)
+	if !b.IsBotDM(name) {
+		return
+	}
+	post := model.PostFromJson(strings.NewReader(event.Data["post"].(string)))
+	if post == nil || post.UserId == b.botUser.Id {
+		return
+	}
+
+	b.onboarding.Lock()
+	defer b.onboarding.Unlock()
+	var j Journey
+	if found, err := b.store.Get(onboardingNamespace, post.UserId, &j); !found || err != nil {
+		return err
+	}
+	if j.Answered == nil {
+		j.Answered = make(map[string]bool)
+	}
+
+	reply := func(name string, data *MessageData) {
+		msg, err := b.RenderMessage(name, data)
+		if err != nil {
+			fmt.Printf("couldn't render the %s message: %v\n", name, err)
+			return
+		}
+		b.SendDirectMessage(ctx, post.UserId, msg)
+	}
+	switch b.onboardingAnswer(&j, post.Message) {
+	case "stop":
+		j.Stopped = true
+		if err = b.store.Put(onboardingNamespace, j.UserId, j); err != nil {
+			return
+		}
+		b.Audit(AuditEntry{Action: AuditOnboarding, UserId: j.UserId, Detail: "stopped"})
+		reply("onboarding-stopped", b.journeyData(ctx, &j))
+		return
+	case "join":
+		m := joinRe.FindStringSubmatch(post.Message)
+		refs := strings.FieldsFunc(strings.ToLower(m[1]), func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+		if len(refs) == 0 && len(j.Offered) == 0 {
+			reply("onboarding-nothing-to-join", b.journeyData(ctx, &j))
+			return
+		}
+		reply("onboarding-joined", b.JoinChannels(ctx, &j, refs))
+	case ExpectInterests:
+		j.Answered[b.lastStep(&j).Message] = true
+		j.Interests = ParseInterests(post.Message)
+		b.Audit(AuditEntry{Action: AuditOnboarding, UserId: j.UserId, Detail: "interested in " + strings.Join(j.Interests, ", ")})
+		reply("onboarding-interests-noted", b.journeyData(ctx, &j))
+	case ExpectFeedback:
+		j.Answered[b.lastStep(&j).Message] = true
+		b.forwardFeedback(ctx, post)
+		reply("onboarding-feedback-noted", b.journeyData(ctx, &j))
+	default:
+		return
+	}
+	return b.store.Put(onboardingNamespace, j.UserId, j)
+}
+
+// forwardFeedback passes what a new member said about their onboarding on to the admins
+func (b *Bot) forwardFeedback(ctx context.Context, post *model.Post) {
+	var author string
+	if user, resp := b.api(ctx).GetUser(post.UserId, ""); resp.Error == nil {
+		author = user.Username
+	}
+	// each admin reads it in their own language
+	message := func(userId string) string {
+		return b.Say(ctx, userId, "onboarding-feedback", func(d *MessageData) { d.Author, d.Message = author, post.Message })
+	}
+	admins := b.cfg().Admins
+	if len(admins) == 0 {
+		b.SendMsgToDebuggingChannel(message(""), "")
+		return
+	}
+	for _, name := range admins {
+		user, resp := b.api(ctx).GetUserByUsername(strings.TrimPrefix(name, "@"), "")
+		if resp.Error != nil {
+			fmt.Printf("couldn't find the admin %s: %v\n", name, resp.Error.Message)
+			continue
+		}
+		b.SendDirectMessage(ctx, user.Id, message(user.Id))
+	}
+}
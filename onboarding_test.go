@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHandleOnboardingReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		replies []string
+		want    string // in the last reply
+		check   func(tb *testBot, j Journey) bool
+	}{
+		{"interests", []string{"Hosting and app development"}, "~app-dev, ~holoport-host-qa",
+			func(tb *testBot, j Journey) bool { return len(j.Interests) == 2 }},
+		{"joining a channel", []string{"join ~app-dev"}, "~app-dev",
+			func(tb *testBot, j Journey) bool { return tb.s.IsChannelMember(tb.channel("app-dev").Id, tb.alice.Id) }},
+		{"joining what was suggested", []string{"hosting", "join"}, "~holoport-host-qa",
+			func(tb *testBot, j Journey) bool {
+				return tb.s.IsChannelMember(tb.channel("holoport-host-qa").Id, tb.alice.Id)
+			}},
+		{"joining with nothing suggested", []string{"join"}, "I don't have any channels left to suggest",
+			func(tb *testBot, j Journey) bool { return true }},
+		{"stopping", []string{"stop"}, "I won't send you any more welcome messages",
+			func(tb *testBot, j Journey) bool { return j.Stopped }},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		tb.s.AddChannel("holoport-host-qa", tb.team).Purpose = "Questions about hosting on a HoloPort"
+		tb.s.AddChannel("app-dev", tb.team)
+		if err := tb.StartOnboarding(context.Background(), tb.alice.Id); err != nil {
+			t.Fatal(err)
+		}
+		dm := tb.dm(tb.alice)
+		for _, msg := range tt.replies {
+			if err := tb.HandleOnboardingReplies(context.Background(), tb.post(tb.alice, dm, msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := tb.sentTo(dm, 0)
+		if last := got[len(got)-1]; !strings.Contains(last, tt.want) {
+			t.Errorf("%s: the last reply is %q, want %q in it", tt.name, last, tt.want)
+		}
+		var j Journey
+		tb.store.Get(onboardingNamespace, tb.alice.Id, &j)
+		if !tt.check(tb, j) {
+			t.Errorf("%s: the journey is %+v", tt.name, j)
+		}
+	}
+}
+
+func TestHandleOnboardingRepliesLeavesOthersAlone(t *testing.T) {
+	tb := newTestBot(t)
+	bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+	tb.StartOnboarding(context.Background(), tb.alice.Id)
+	n := len(tb.s.Created)
+
+	// bob isn't being onboarded, and a command isn't an answer
+	tb.HandleOnboardingReplies(context.Background(), tb.post(bob, tb.dm(bob), "stop"))
+	tb.HandleOnboardingReplies(context.Background(), tb.post(tb.alice, tb.dm(tb.alice), "@holobot help"))
+	if len(tb.s.Created) != n {
+		t.Errorf("replied with %q", tb.s.Created[n].Message)
+	}
+}
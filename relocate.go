@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+)
+
+// discussion threads we started about posts in moderated channels, keyed by
+// "<post id>:<channel id>" of the post discussed and the channel discussing it
+const discussionsNamespace = "discussions"
+
+// Discussion is a thread we started to discuss a post somewhere else
+type Discussion struct {
+	ChannelId string
+	RootId    string
+}
+
+// moveTarget finds where posts breaking a rule in a channel can be moved to:
+// the rule's MoveTo channel, on the channel's own team unless it names one
+func (b *Bot) moveTarget(ctx context.Context, rule *ModerationRule, channelId string) (channel *model.Channel, team *model.Team, target *model.Channel, err error) {
+	channel, resp := b.api(ctx).GetChannel(channelId, "")
+	if resp.Error != nil {
+		return nil, nil, nil, resp.Error
+	}
+	team, resp = b.api(ctx).GetTeam(channel.TeamId, "")
+	if resp.Error != nil {
+		return nil, nil, nil, resp.Error
+	}
+	ref := b.moveToName(rule)
+	if !strings.Contains(ref, "/") {
+		ref = team.Name + "/" + ref
+	}
+	if target = b.FindChannelRef(ctx, ref); target == nil {
+		return nil, nil, nil, fmt.Errorf("couldn't find the channel %s", ref)
+	}
+	return
+}
+
+// DiscussionThread returns the id of the thread in target where the post is
+// discussed, starting one that quotes it if there isn't one yet
+func (b *Bot) DiscussionThread(ctx context.Context, post *model.Post, team *model.Team, channel, target *model.Channel) (string, error) {
+	b.discussions.Lock()
+	defer b.discussions.Unlock()
+
+	key := post.Id + ":" + target.Id
+	var d Discussion
+	found, err := b.store.Get(discussionsNamespace, key, &d)
+	if err != nil {
+		return "", err
+	}
+	// someone may have deleted it since
+	if found {
+		if _, resp := b.api(ctx).GetPost(d.RootId, ""); resp.Error == nil {
+			return d.RootId, nil
+		}
+	}
+
+	// it's for everyone in the channel, so it's in the default locale
+	msg := b.Say(ctx, "", "discussion-started", func(d *MessageData) {
+		if user, resp := b.api(ctx).GetUser(post.UserId, ""); resp.Error == nil {
+			d.Author = user.Username
+		}
+		d.Link, d.Channel, d.Message = b.Permalink(team.Name, post.Id), channel.Name, post.Message
+	})
+	root, resp := b.api(ctx).CreatePost(&model.Post{ChannelId: target.Id, Message: msg})
+	if resp.Error != nil {
+		return "", resp.Error
+	}
+	d = Discussion{ChannelId: target.Id, RootId: root.Id}
+	if err = b.store.Put(discussionsNamespace, key, d); err != nil {
+		fmt.Printf("couldn't remember the discussion of %s: %v\n", post.Id, err)
+	}
+	return root.Id, nil
+}
+
+// movedPost is the text of a post reposted somewhere else by the bot, from the
+// catalog message called name. Everyone there reads it, so it's in the default locale.
+func (b *Bot) movedPost(ctx context.Context, name string, post *model.Post, author, channel string) string {
+	fill := func(d *MessageData) { d.Author, d.Channel, d.Message = author, channel, post.Message }
+	msg := b.Say(ctx, "", name, fill)
+	if len(post.FileIds) > 0 {
+		msg += "\n\n" + b.Say(ctx, "", "attachments-not-moved", fill)
+	}
+	return msg
+}
+
+// RelocateReply moves a reply to a post in a moderated channel into the post's
+// discussion thread in the rule's MoveTo channel, and returns a link to it there.
+// actor is who asked for it to be moved, "" if nobody did.
+func (b *Bot) RelocateReply(ctx context.Context, rule *ModerationRule, post *model.Post, sender, actor string) (link string, target *model.Channel, err error) {
+	channel, team, target, err := b.moveTarget(ctx, rule, post.ChannelId)
+	if err != nil {
+		return
+	}
+	discussed, resp := b.api(ctx).GetPost(post.RootId, "")
+	if resp.Error != nil {
+		return "", nil, resp.Error
+	}
+	rootId, err := b.DiscussionThread(ctx, discussed, team, channel, target)
+	if err != nil {
+		return
+	}
+
+	msg := b.movedPost(ctx, "reply-relocated", post, sender, channel.Name)
+	e := b.postAudit(ctx, AuditMovePost, post, sender, rule, "to the discussion in ~"+target.Name)
+	e.Actor = actor
+	defer func() {
+		e.Outcome = outcome(err)
+		b.Audit(e)
+	}()
+	moved, resp := b.api(ctx).CreatePost(&model.Post{ChannelId: target.Id, RootId: rootId, Message: msg})
+	if resp.Error != nil {
+		return "", nil, resp.Error
+	}
+	if _, resp := b.api(ctx).DeletePost(post.Id); resp.Error != nil {
+		return "", nil, resp.Error
+	}
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("* **Moved @%s's reply to the discussion in ~%s.**", sender, target.Name), "")
+	return b.Permalink(team.Name, moved.Id), target, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// channels in shadow mode, by channel id
+	shadowChannelsNamespace = "shadow-channels"
+	// what shadow mode would have deleted, keyed by "<millis>-<post id>" so the keys sort by time
+	shadowDecisionsNamespace = "shadow-decisions"
+
+	shadowRetention = 90 * 24 * time.Hour
+)
+
+// ShadowDecision is a post a rule in shadow mode would have deleted
+type ShadowDecision struct {
+	At        int64 // millis
+	ChannelId string
+	Channel   string
+	PostId    string
+	UserId    string
+	Username  string
+	Rule      string
+	Reason    string
+	Message   string
+}
+
+// InShadowMode reports whether a rule only records what it would do in a channel
+func (b *Bot) InShadowMode(rule *ModerationRule, channelId string) bool {
+	if rule.Shadow {
+		return true
+	}
+	var on bool
+	if _, err := b.store.Get(shadowChannelsNamespace, channelId, &on); err != nil {
+		fmt.Printf("error reading the shadow mode of %s: %v\n", channelId, err)
+	}
+	return on
+}
+
+// RecordShadowDecision remembers, and reports to the debugging channel, that a
+// post would have been deleted
+func (b *Bot) RecordShadowDecision(d ShadowDecision) error {
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("* **Shadow mode:** I would have deleted this post by @%s in ~%s because it breaks the rule _%s_: %s", d.Username, d.Channel, d.Rule, d.Reason), "")
+	key := fmt.Sprintf("%013d-%s", d.At, d.PostId)
+	if err := b.store.Put(shadowDecisionsNamespace, key, d); err != nil {
+		fmt.Printf("couldn't record a shadow decision: %v\n", err)
+		return err
+	}
+	return b.pruneShadowDecisions()
+}
+
+// pruneShadowDecisions forgets decisions older than shadowRetention
+func (b *Bot) pruneShadowDecisions() error {
+	keys, err := b.store.Keys(shadowDecisionsNamespace)
+	if err != nil {
+		return err
+	}
+	cutoff := fmt.Sprintf("%013d", model.GetMillis()-int64(shadowRetention/time.Millisecond))
+	for _, key := range keys {
+		if key >= cutoff {
+			break
+		}
+		if err = b.store.Delete(shadowDecisionsNamespace, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShadowDecisions returns the decisions made since a time, oldest first
+func (b *Bot) ShadowDecisions(since time.Time) (decisions []ShadowDecision, err error) {
+	keys, err := b.store.Keys(shadowDecisionsNamespace)
+	if err != nil {
+		return
+	}
+	from := fmt.Sprintf("%013d", since.UnixNano()/int64(time.Millisecond))
+	for _, key := range keys {
+		if key < from {
+			continue
+		}
+		var d ShadowDecision
+		if _, err = b.store.Get(shadowDecisionsNamespace, key, &d); err != nil {
+			return
+		}
+		decisions = append(decisions, d)
+	}
+	return
+}
+
+// ShadowReport summarises what shadow mode would have deleted in the last
+// days, worded by say from the catalog messages it names
+func ShadowReport(decisions []ShadowDecision, days int, say func(name string, fill func(d *MessageData)) string) string {
+	period := func(d *MessageData) { d.Value, d.Count = strconv.Itoa(days), len(decisions) }
+	if len(decisions) == 0 {
+		return say("shadow-report-none", period)
+	}
+	type count struct {
+		key string
+		n   int
+	}
+	tally := func(key func(d ShadowDecision) string) (counts []count) {
+		seen := make(map[string]int)
+		for _, d := range decisions {
+			k := key(d)
+			if i, ok := seen[k]; ok {
+				counts[i].n++
+				continue
+			}
+			seen[k] = len(counts)
+			counts = append(counts, count{k, 1})
+		}
+		sort.SliceStable(counts, func(i, j int) bool { return counts[i].n > counts[j].n })
+		return
+	}
+
+	none := func(d *MessageData) {}
+	text := say("shadow-report-heading", period) + "\n\n"
+	text += say("shadow-report-columns", none) + "\n|---|---|---|---|\n"
+	for _, c := range tally(func(d ShadowDecision) string { return d.Rule + "\x00~" + d.Channel + "\x00" + d.Reason }) {
+		parts := strings.SplitN(c.key, "\x00", 3)
+		text += fmt.Sprintf("| %s | %s | %s | %d |\n", parts[0], parts[1], parts[2], c.n)
+	}
+	text += "\n" + say("shadow-report-authors", none) + "\n|---|---|\n"
+	for i, c := range tally(func(d ShadowDecision) string { return "@" + d.Username }) {
+		if i == 10 {
+			break
+		}
+		text += fmt.Sprintf("| %s | %d |\n", c.key, c.n)
+	}
+	text += "\n" + say("shadow-report-recent", none)
+	for i := len(decisions) - 1; i >= 0 && i >= len(decisions)-5; i-- {
+		d := decisions[i]
+		excerpt := strings.Replace(d.Message, "\n", " ", -1)
+		if r := []rune(excerpt); len(r) > 80 {
+			excerpt = string(r[:80]) + "…"
+		}
+		text += "\n* " + say("shadow-report-post", func(m *MessageData) {
+			m.Value, m.Author, m.Channel, m.Rule, m.Message = time.Unix(0, d.At*int64(time.Millisecond)).UTC().Format("Jan 2 15:04"), d.Username, d.Channel, d.Rule, excerpt
+		})
+	}
+	return text
+}
+
+// HandleShadowCommand shows or changes whether a moderated channel is in shadow mode
+func (b *Bot) HandleShadowCommand(inv *Invocation) error {
+	channelId := inv.Post.ChannelId
+	name := "" // this channel
+	if ref := inv.Flag("channel"); ref != "" {
+		channel := b.FindChannelRef(inv.Context(), ref)
+		if channel == nil {
+			inv.Reply(inv.Phrase("channel-not-found", ref))
+			return nil
+		}
+		channelId, name = channel.Id, channel.Name
+	}
+	inChannel := func(d *MessageData) { d.Channel = name }
+	rules := b.ModerationRules(channelId)
+	if len(rules) == 0 {
+		inv.Reply(inv.Say("shadow-not-moderated", inChannel))
+		return nil
+	}
+
+	mode := strings.ToLower(inv.Arg("mode"))
+	var err error
+	switch mode {
+	case "":
+	case "on":
+		err = b.store.Put(shadowChannelsNamespace, channelId, true)
+	case "off":
+		err = b.store.Delete(shadowChannelsNamespace, channelId)
+	default:
+		inv.Reply(inv.Phrase("shadow-modes", ""))
+		return nil
+	}
+	if mode != "" {
+		b.Audit(AuditEntry{Actor: inv.Sender(), Action: AuditShadowMode, ChannelId: channelId, Channel: b.ChannelName(inv.Context(), channelId),
+			Detail: mode, Outcome: outcome(err)})
+	}
+	if err != nil {
+		inv.Reply(inv.Phrase("not-saved", ""))
+		return err
+	}
+
+	text := []string{inv.Say("shadow-rules", inChannel)}
+	for i := range rules {
+		state := "shadow-rule-enforced"
+		if b.InShadowMode(&rules[i], channelId) {
+			state = "shadow-rule-shadow"
+		}
+		text = append(text, "* "+inv.Say(state, func(d *MessageData) { d.Rule = rules[i].Name }))
+	}
+	inv.Reply(strings.Join(text, "\n"))
+	return nil
+}
+
+// HandleShadowReportCommand replies with what shadow mode would have deleted
+func (b *Bot) HandleShadowReportCommand(inv *Invocation) error {
+	days := 7
+	if arg := inv.Arg("days"); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			inv.Reply(inv.Phrase("shadow-bad-days", arg))
+			return nil
+		}
+		days = n
+	}
+	decisions, err := b.ShadowDecisions(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		inv.Reply(inv.Phrase("shadow-unreadable", ""))
+		return err
+	}
+	inv.Reply(ShadowReport(decisions, days, inv.Say))
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// Store is a key/value store for state the bot keeps across restarts. Keys live
+// in namespaces, one per feature (e.g. "welcome", "warnings"), and values are
+// anything that can be encoded as JSON.
+type Store interface {
+	// Get decodes the value stored under key into value and reports whether there was one
+	Get(namespace, key string, value interface{}) (found bool, err error)
+	Put(namespace, key string, value interface{}) error
+	Delete(namespace, key string) error
+	// Keys returns the keys in a namespace in sorted order
+	Keys(namespace string) ([]string, error)
+}
+
+// StoreVersion is the schema version written into every namespace file.
+// Bump it and add a storeMigrations entry when the layout of stored data changes.
+const StoreVersion = 1
+
+// storeMigrations upgrade a namespace's entries from the version they're keyed
+// by to the next one
+var storeMigrations = map[int]func(namespace string, entries map[string]json.RawMessage) error{}
+
+var validNamespace = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// storeFile is the on-disk format of a namespace
+type storeFile struct {
+	Version int
+	Entries map[string]json.RawMessage
+}
+
+// FileStore keeps each namespace in its own JSON file in a directory. Every
+// change rewrites the namespace file atomically, so a crash never leaves a
+// half-written file behind.
+type FileStore struct {
+	dir string
+
+	lk         sync.Mutex
+	namespaces map[string]map[string]json.RawMessage
+}
+
+// NewFileStore opens (creating if needed) a store in dir
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, os.FileMode(OS_USER_RWX)); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, namespaces: make(map[string]map[string]json.RawMessage)}, nil
+}
+
+// load returns the entries of a namespace, reading its file the first time.
+// The caller must hold s.lk.
+func (s *FileStore) load(namespace string) (entries map[string]json.RawMessage, err error) {
+	if !validNamespace.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid store namespace %q", namespace)
+	}
+	if entries = s.namespaces[namespace]; entries != nil {
+		return
+	}
+	entries = make(map[string]json.RawMessage)
+	path := filepath.Join(s.dir, namespace+".json")
+	if FileExists(path) {
+		var f *os.File
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		var sf storeFile
+		if err = Decode(f, "json", &sf); err != nil {
+			return nil, fmt.Errorf("couldn't read %s: %v", path, err)
+		}
+		if sf.Version > StoreVersion {
+			return nil, fmt.Errorf("%s was written by a newer holobot (schema version %d, we understand up to %d)", path, sf.Version, StoreVersion)
+		}
+		if sf.Entries != nil {
+			entries = sf.Entries
+		}
+		for v := sf.Version; v < StoreVersion; v++ {
+			if migrate := storeMigrations[v]; migrate != nil {
+				if err = migrate(namespace, entries); err != nil {
+					return nil, fmt.Errorf("couldn't migrate %s from schema version %d: %v", path, v, err)
+				}
+			}
+		}
+	}
+	s.namespaces[namespace] = entries
+	return
+}
+
+// save atomically rewrites a namespace's file. The caller must hold s.lk.
+func (s *FileStore) save(namespace string, entries map[string]json.RawMessage) (err error) {
+	tmp, err := ioutil.TempFile(s.dir, "."+namespace+".json.")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = Encode(tmp, "json", storeFile{Version: StoreVersion, Entries: entries}); err != nil {
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, namespace+".json"))
+}
+
+func (s *FileStore) Get(namespace, key string, value interface{}) (found bool, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	entries, err := s.load(namespace)
+	if err != nil {
+		return
+	}
+	raw, found := entries[key]
+	if !found {
+		return
+	}
+	err = json.Unmarshal(raw, value)
+	return
+}
+
+func (s *FileStore) Put(namespace, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	entries, err := s.load(namespace)
+	if err != nil {
+		return err
+	}
+	old, had := entries[key]
+	entries[key] = raw
+	if err = s.save(namespace, entries); err != nil {
+		// keep the cache in step with what's on disk
+		if had {
+			entries[key] = old
+		} else {
+			delete(entries, key)
+		}
+	}
+	return err
+}
+
+func (s *FileStore) Delete(namespace, key string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	entries, err := s.load(namespace)
+	if err != nil {
+		return err
+	}
+	old, had := entries[key]
+	if !had {
+		return nil
+	}
+	delete(entries, key)
+	if err = s.save(namespace, entries); err != nil {
+		entries[key] = old
+	}
+	return err
+}
+
+func (s *FileStore) Keys(namespace string) ([]string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	entries, err := s.load(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(entries), nil
+}
+
+func sortedKeys(entries map[string]json.RawMessage) (keys []string) {
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// MemStore is a Store that only lives in memory, for tests. Values are stored
+// encoded, just like FileStore, so callers can't share state by accident.
+type MemStore struct {
+	lk         sync.Mutex
+	namespaces map[string]map[string]json.RawMessage
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{namespaces: make(map[string]map[string]json.RawMessage)}
+}
+
+func (s *MemStore) Get(namespace, key string, value interface{}) (found bool, err error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	raw, found := s.namespaces[namespace][key]
+	if !found {
+		return
+	}
+	err = json.Unmarshal(raw, value)
+	return
+}
+
+func (s *MemStore) Put(namespace, key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.namespaces[namespace] == nil {
+		s.namespaces[namespace] = make(map[string]json.RawMessage)
+	}
+	s.namespaces[namespace][key] = raw
+	return nil
+}
+
+func (s *MemStore) Delete(namespace, key string) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	delete(s.namespaces[namespace], key)
+	return nil
+}
+
+func (s *MemStore) Keys(namespace string) ([]string, error) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return sortedKeys(s.namespaces[namespace]), nil
+}
+
+var _ Store = (*FileStore)(nil)
+var _ Store = (*MemStore)(nil)
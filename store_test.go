@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type storeEntry struct {
+	Name  string
+	Count int
+}
+
+// testStores returns a FileStore in a temporary directory and a MemStore, and
+// a function that cleans up after them
+func testStores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"FileStore": fs, "MemStore": NewMemStore()}, func() { os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		var got storeEntry
+		if found, err := s.Get("things", "a", &got); found || err != nil {
+			t.Errorf("%s: Get from an empty namespace found %v, %v", name, found, err)
+		}
+		if keys, err := s.Keys("things"); len(keys) != 0 || err != nil {
+			t.Errorf("%s: an empty namespace has the keys %v, %v", name, keys, err)
+		}
+
+		for _, key := range []string{"c", "a", "b"} {
+			if err := s.Put("things", key, storeEntry{Name: key, Count: 1}); err != nil {
+				t.Fatalf("%s: Put %s: %v", name, key, err)
+			}
+		}
+		s.Put("things", "a", storeEntry{Name: "a", Count: 2})
+		s.Put("others", "z", storeEntry{Name: "z"})
+
+		if found, err := s.Get("things", "a", &got); !found || err != nil || got != (storeEntry{"a", 2}) {
+			t.Errorf("%s: Get a got %+v, %v, %v", name, got, found, err)
+		}
+		if keys, _ := s.Keys("things"); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+			t.Errorf("%s: got the keys %v, want a, b, c", name, keys)
+		}
+
+		for _, key := range []string{"b", "nope"} {
+			if err := s.Delete("things", key); err != nil {
+				t.Errorf("%s: Delete %s: %v", name, key, err)
+			}
+		}
+		if found, _ := s.Get("things", "b", &got); found {
+			t.Errorf("%s: b is still there after deleting it", name)
+		}
+		if keys, _ := s.Keys("things"); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+			t.Errorf("%s: got the keys %v after deleting b, want a, c", name, keys)
+		}
+		if keys, _ := s.Keys("others"); !reflect.DeepEqual(keys, []string{"z"}) {
+			t.Errorf("%s: the other namespace has %v, want z", name, keys)
+		}
+	}
+}
+
+func TestStoreCopiesValues(t *testing.T) {
+	stores, cleanup := testStores(t)
+	defer cleanup()
+	for name, s := range stores {
+		value := []string{"a"}
+		s.Put("things", "list", value)
+		value[0] = "changed"
+		var got []string
+		if s.Get("things", "list", &got); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Errorf("%s: got %v, want what was Put", name, got)
+		}
+	}
+}
+
+func TestFileStoreSurvivesARestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := NewFileStore(dir)
+	s.Put("things", "a", storeEntry{Name: "a", Count: 1})
+	s.Put("things", "b", storeEntry{Name: "b", Count: 2})
+	s.Delete("things", "a")
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got storeEntry
+	if found, err := reopened.Get("things", "b", &got); !found || err != nil || got != (storeEntry{"b", 2}) {
+		t.Errorf("after a restart b is %+v, %v, %v", got, found, err)
+	}
+	if keys, _ := reopened.Keys("things"); !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("after a restart got the keys %v, want b", keys)
+	}
+	// nothing is left behind from the atomic writes
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("got the files %v, want things.json", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, ".*")); len(files) != 0 {
+		t.Errorf("left the temporary files %v", files)
+	}
+}
+
+func TestFileStoreRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, _ := NewFileStore(dir)
+
+	if err := s.Put("../escape", "a", 1); err == nil {
+		t.Error("Put into ../escape worked")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "future.json"), []byte(`{"Version": 99, "Entries": {}}`), 0644)
+	if _, err := s.Keys("future"); err == nil {
+		t.Error("read a namespace from a newer schema version")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{"Version": `), 0644)
+	if _, err := s.Get("broken", "a", new(int)); err == nil {
+		t.Error("read a broken namespace file")
+	}
+}
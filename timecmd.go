@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TimeZone is one column of the `time` command's table
+type TimeZone struct {
+	Label    string // e.g. "PT", defaults to the zone's abbreviation
+	Location string // IANA zone name, e.g. "America/Los_Angeles"
+	Clock24  bool   // show 15:04 instead of 3:04 PM
+}
+
+// the zones our team members live in, used when the config doesn't list any
+var defaultTimeZones = []TimeZone{
+	{Label: "PT", Location: "America/Los_Angeles"},
+	{Label: "MT", Location: "America/Denver"},
+	{Label: "CT", Location: "America/Chicago"},
+	{Label: "ET", Location: "America/New_York"},
+	{Label: "GMT", Location: "Etc/GMT", Clock24: true},
+	{Label: "CET", Location: "Europe/Paris", Clock24: true},
+	{Label: "IST", Location: "Asia/Kolkata"},
+	{Label: "ADT", Location: "Australia/Melbourne"},
+}
+
+// names people use for time zones in their messages. TimeZoneAliases in the
+// config adds to (or overrides) these.
+var defaultTimeZoneAliases = map[string]string{
+	"PST": "America/Los_Angeles", "PT": "America/Los_Angeles", "PACIFIC": "America/Los_Angeles",
+	"MST": "America/Denver", "MT": "America/Denver", "MOUNTAIN": "America/Denver",
+	"CST": "America/Chicago", "CT": "America/Chicago", "CENTRAL": "America/Chicago",
+	"EST": "America/New_York", "EDT": "America/New_York", "ET": "America/New_York", "EASTERN": "America/New_York", "EAST": "America/New_York",
+	"GMT": "Etc/UTC", "UTC": "Etc/UTC", "GREENWICH": "Etc/UTC", "WET": "Etc/UTC",
+	"CHINA": "Asia/Shanghai", "CHINESE": "Asia/Shanghai", "SHANGHAI": "Asia/Shanghai", "BEIJING": "Asia/Shanghai",
+	"ECT": "America/Guayaquil", "QUITO": "America/Guayaquil", "ECUADOR": "America/Guayaquil", "ECUADORIAN": "America/Guayaquil",
+	"IST": "Asia/Kolkata", "INDIAN": "Asia/Kolkata", "INDIA": "Asia/Kolkata",
+	"ADT": "Australia/Melbourne", "AEDT": "Australia/Melbourne", "ASDT": "Australia/Melbourne", "AUSTRALIA": "Australia/Melbourne", "MELBOURNE": "Australia/Melbourne",
+}
+
+// per channel and per user zone sets are kept in the store under
+// "channel:<id>" and "user:<id>"
+const timeZonesNamespace = "timezones"
+
+func (cfg *Config) timeZones() []TimeZone {
+	if len(cfg.TimeZones) > 0 {
+		return cfg.TimeZones
+	}
+	return defaultTimeZones
+}
+
+func (cfg *Config) timeZoneAliases() map[string]string {
+	aliases := make(map[string]string, len(defaultTimeZoneAliases)+len(cfg.TimeZoneAliases))
+	for name, loc := range defaultTimeZoneAliases {
+		aliases[name] = loc
+	}
+	for name, loc := range cfg.TimeZoneAliases {
+		aliases[strings.ToUpper(name)] = loc
+	}
+	return aliases
+}
+
+// ResolveZone turns a name from a message or a command, either an alias like
+// "PST" or an IANA name like "Asia/Tokyo", into a location
+func (b *Bot) ResolveZone(name string) (*time.Location, error) {
+	if loc, ok := b.cfg().timeZoneAliases()[strings.ToUpper(name)]; ok {
+		return time.LoadLocation(loc)
+	}
+	if name == "" || strings.ToLower(name) == "local" {
+		// LoadLocation would happily give us the server's zone
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// TimeZonesFor returns the zones to show a user in a channel: their own set if
+// they have one, then the channel's, then the configured one
+func (b *Bot) TimeZonesFor(channelId, userId string) (zones []TimeZone, source string) {
+	for _, key := range []string{"user:" + userId, "channel:" + channelId} {
+		if strings.HasSuffix(key, ":") {
+			continue
+		}
+		found, err := b.store.Get(timeZonesNamespace, key, &zones)
+		if err != nil {
+			fmt.Printf("error reading time zones for %s: %v\n", key, err)
+			continue
+		}
+		if found {
+			return zones, strings.SplitN(key, ":", 2)[0]
+		}
+	}
+	return b.cfg().timeZones(), "config"
+}
+
+// TimeTable renders what time a TimeExpr is in each of the zones. The heading
+// gives the date in the first zone unless that's simply today, and any time
+// that falls on another date is marked with its own. Columns in the highlight
+// location (if it isn't "") are shown in bold. heading words the heading for
+// the time's text and that date, which is "" when it's left out.
+func TimeTable(e TimeExpr, zones []TimeZone, now time.Time, highlight string, heading func(text, on string) string) string {
+	var first time.Time
+	header, align, row := "|", "|", "|"
+	for _, z := range zones {
+		value := "?"
+		if l, err := time.LoadLocation(z.Location); err == nil {
+			layout := "3:04 PM"
+			if z.Clock24 {
+				layout = "15:04"
+			}
+			start := e.Start.In(l)
+			if first.IsZero() {
+				first = start
+			}
+			value = start.Format(layout)
+			if !sameDay(start, first) {
+				value += start.Format(" (Mon Jan 2)")
+			}
+			if !e.End.IsZero() {
+				end := e.End.In(l)
+				value += " – " + end.Format(layout)
+				if !sameDay(end, start) {
+					value += end.Format(" (Mon Jan 2)")
+				}
+			}
+		}
+		label := z.Label
+		if highlight != "" && z.Location == highlight {
+			label, value = "**"+label+"**", "**"+value+"**"
+		}
+		header += " " + label + " |"
+		align += ":---:|"
+		row += " " + value + " |"
+	}
+
+	on := ""
+	if !first.IsZero() && (!sameDay(first, now.In(first.Location())) || strings.Contains(row, " (")) {
+		on = fmt.Sprintf("%s (%s)", first.Format("Monday, January 2"), zones[0].Label)
+	}
+	return fmt.Sprintf("%s\n\n%s\n%s\n%s", heading(e.Text, on), header, align, row)
+}
+
+// timeHeading words the headings of TimeTables for a user, or for "" in the
+// default locale
+func (b *Bot) timeHeading(ctx context.Context, userId string) func(text, on string) string {
+	data := b.messageData(ctx, userId)
+	return func(text, on string) string {
+		d := *data
+		d.Message, d.Value = text, on
+		heading, err := b.RenderMessage("time-heading", &d)
+		if err != nil {
+			fmt.Printf("couldn't render the time-heading message: %v\n", err)
+			return fmt.Sprintf("\"%s\":", text)
+		}
+		return heading
+	}
+}
+
+func sameDay(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd
+}
+
+// UserTimeZone returns the time zone a user has in their Mattermost profile,
+// automatic or manual
+func (b *Bot) UserTimeZone(ctx context.Context, userId string) (*time.Location, error) {
+	user, resp := b.api(ctx).GetUser(userId, "")
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return userLocation(user)
+}
+
+func userLocation(user *model.User) (*time.Location, error) {
+	name := model.GetPreferredTimezone(user.Timezone)
+	if name == "" {
+		return nil, timeError("time-no-zone", user.Username, fmt.Sprintf("@%s hasn't set a time zone", user.Username))
+	}
+	return time.LoadLocation(name)
+}
+
+// timeErrorText says why a time didn't make sense, in the user's language if
+// the catalog knows how
+func (b *Bot) timeErrorText(ctx context.Context, userId string, err error) string {
+	if e, ok := err.(*TimeError); ok {
+		return b.Phrase(ctx, userId, e.Key, e.Value)
+	}
+	return err.Error()
+}
+
+// personalTimeZones adds a user's profile time zone to zones, unless it's
+// already there, and returns the location to highlight for them
+func (b *Bot) personalTimeZones(ctx context.Context, userId string, zones []TimeZone) ([]TimeZone, string) {
+	l, err := b.UserTimeZone(ctx, userId)
+	if err != nil {
+		return zones, ""
+	}
+	for _, z := range zones {
+		if z.Location == l.String() {
+			return zones, z.Location
+		}
+	}
+	return append([]TimeZone{{Label: b.Phrase(ctx, userId, "time-you", ""), Location: l.String()}}, zones...), l.String()
+}
+
+// HandleTimeCommand replies with a table converting every time mentioned in the
+// post into the time zones our team members live in. When the reply only goes
+// to the requester, their own time zone is highlighted.
+func (b *Bot) HandleTimeCommand(inv *Invocation) error {
+	post := inv.Post
+	zones, _ := b.TimeZonesFor(post.ChannelId, post.UserId)
+	now := time.Now()
+	highlight := ""
+	if inv.recipient() != "" {
+		zones, highlight = b.personalTimeZones(inv.Context(), post.UserId, zones)
+	}
+	heading := b.timeHeading(inv.Context(), inv.recipient())
+	for _, e := range ParseTimes(post.Message, now, b.ResolveZone) {
+		var timeZoneText string
+		var debuggingTimeZoneText string
+
+		// converts time into the desired output time zones,
+		if e.Err != nil {
+			fmt.Printf("error parsing time %q: %v\n", e.Text, e.Err)
+			data := b.messageData(inv.Context(), inv.recipient())
+			data.Message, data.Reason = e.Text, b.timeErrorText(inv.Context(), inv.recipient(), e.Err)
+			var err error
+			if timeZoneText, err = b.RenderMessage("time-not-understood", data); err != nil {
+				timeZoneText = fmt.Sprintf("I couldn't understand the time \"%s\": %v.", e.Text, e.Err)
+			}
+		} else {
+			// and prints them in a table
+			timeZoneText = TimeTable(e, zones, now, highlight, heading)
+
+			// make a debugging message with extra info about the above processes
+			debuggingTimeZoneText = fmt.Sprintf("➚ **Debugging Info:**\n(%v – %v)\nTime zone I heard was: %v\nPost.Id: %v\npost.RootId: %v", e.Start, e.End, e.Zone, post.Id, post.RootId)
+		}
+		inv.Reply(timeZoneText)
+		// send debugging message if debugging is turned on
+		if debuggingTimeZoneText != "" {
+			inv.Debug(debuggingTimeZoneText)
+		}
+	}
+	return nil
+}
+
+// HandleTimeForCommand converts the times in the post into the profile time
+// zones of the mentioned users, or tells them what time it is for each of them
+// if the post doesn't mention any
+func (b *Bot) HandleTimeForCommand(inv *Invocation) error {
+	var zones []TimeZone
+	var problems []string
+	columns := make(map[string]int) // location -> index in zones
+	for _, name := range inv.ArgList("users") {
+		name = strings.TrimPrefix(name, "@")
+		user, resp := b.api(inv.Context()).GetUserByUsername(name, "")
+		if resp.Error != nil {
+			problems = append(problems, inv.Phrase("time-unknown-user", name))
+			continue
+		}
+		l, err := userLocation(user)
+		if err != nil {
+			problems = append(problems, b.timeErrorText(inv.Context(), inv.recipient(), err)+".")
+			continue
+		}
+		// people in the same zone share a column
+		if i, ok := columns[l.String()]; ok {
+			zones[i].Label += " @" + user.Username
+			continue
+		}
+		columns[l.String()] = len(zones)
+		zones = append(zones, TimeZone{Label: "@" + user.Username, Location: l.String()})
+	}
+
+	text := strings.Join(problems, " ")
+	if len(zones) > 0 {
+		now := time.Now()
+		exprs := b.scheduledTimes(inv.Post.Message)
+		if len(exprs) == 0 {
+			exprs = []TimeExpr{{Text: inv.Phrase("time-now", ""), Start: now}}
+		}
+		heading := b.timeHeading(inv.Context(), inv.recipient())
+		for _, e := range exprs {
+			if text != "" {
+				text += "\n\n"
+			}
+			text += TimeTable(e, zones, now, "", heading)
+		}
+	}
+	inv.Reply(text)
+	return nil
+}
+
+// timeZonesKey is where `time zones` changes go: the user's own set with
+// --me, otherwise the channel's
+func timeZonesKey(inv *Invocation) (key string, own bool) {
+	if inv.Bool("me") {
+		return "user:" + inv.Post.UserId, true
+	}
+	return "channel:" + inv.Post.ChannelId, false
+}
+
+// editableTimeZones is the set a `time zones` change starts from: what the user
+// currently sees with --me, otherwise the channel's set (ignoring the user's own)
+func (b *Bot) editableTimeZones(inv *Invocation) []TimeZone {
+	if inv.Bool("me") {
+		zones, _ := b.TimeZonesFor(inv.Post.ChannelId, inv.Post.UserId)
+		return zones
+	}
+	zones, _ := b.TimeZonesFor(inv.Post.ChannelId, "")
+	return zones
+}
+
+// HandleTimeZonesList shows which zones `time` uses here and where that set comes from
+func (b *Bot) HandleTimeZonesList(inv *Invocation) error {
+	zones, source := b.TimeZonesFor(inv.Post.ChannelId, inv.Post.UserId)
+	text := inv.Phrase("time-zones-"+source, "")
+	for _, z := range zones {
+		clock := inv.Phrase("time-clock-12", "")
+		if z.Clock24 {
+			clock = inv.Phrase("time-clock-24", "")
+		}
+		text += fmt.Sprintf("\n* **%s**: `%s` (%s)", z.Label, z.Location, clock)
+	}
+	inv.Reply(text)
+	return nil
+}
+
+// HandleTimeZonesAdd adds a zone to the channel's (or with --me, the user's) set,
+// starting from the set that currently applies
+func (b *Bot) HandleTimeZonesAdd(inv *Invocation) error {
+	name := inv.Arg("zone")
+	l, err := b.ResolveZone(name)
+	if err != nil {
+		inv.Reply(inv.Phrase("time-unknown-zone", name))
+		return nil
+	}
+	label := inv.Arg("label")
+	if label == "" {
+		label = zoneLabel(l)
+	}
+	key, own := timeZonesKey(inv)
+	zones := b.editableTimeZones(inv)
+	for _, z := range zones {
+		if z.Location == l.String() || strings.EqualFold(z.Label, label) {
+			inv.Reply(inv.Say("time-zone-already-listed", func(d *MessageData) { d.Value, d.Zone = z.Label, z.Location }))
+			return nil
+		}
+	}
+	zones = append(append([]TimeZone{}, zones...), TimeZone{Label: label, Location: l.String(), Clock24: inv.Bool("24h")})
+	if err := b.store.Put(timeZonesNamespace, key, zones); err != nil {
+		inv.Reply(inv.Phrase("not-saved", ""))
+		return err
+	}
+	inv.Reply(inv.Say("time-zone-added", func(d *MessageData) { d.Value, d.Zone, d.Own = label, l.String(), own }))
+	return nil
+}
+
+// HandleTimeZonesRemove removes a zone, by label or location, from the
+// channel's (or with --me, the user's) set
+func (b *Bot) HandleTimeZonesRemove(inv *Invocation) error {
+	name := inv.Arg("zone")
+	key, own := timeZonesKey(inv)
+	zones := b.editableTimeZones(inv)
+	var kept []TimeZone
+	for _, z := range zones {
+		if !strings.EqualFold(z.Label, name) && !strings.EqualFold(z.Location, name) {
+			kept = append(kept, z)
+		}
+	}
+	switch {
+	case len(kept) == len(zones):
+		inv.Reply(inv.Phrase("time-zone-not-listed", name))
+		return nil
+	case len(kept) == 0:
+		inv.Reply(inv.Phrase("time-last-zone", ""))
+		return nil
+	}
+	if err := b.store.Put(timeZonesNamespace, key, kept); err != nil {
+		inv.Reply(inv.Phrase("not-saved", ""))
+		return err
+	}
+	inv.Reply(inv.Say("time-zone-removed", func(d *MessageData) { d.Value, d.Own = name, own }))
+	return nil
+}
+
+// HandleTimeZonesReset drops the channel's (or with --me, the user's) own set
+func (b *Bot) HandleTimeZonesReset(inv *Invocation) error {
+	key, own := timeZonesKey(inv)
+	if err := b.store.Delete(timeZonesNamespace, key); err != nil {
+		inv.Reply(inv.Phrase("not-saved", ""))
+		return err
+	}
+	inv.Reply(inv.Say("time-zones-reset", func(d *MessageData) { d.Own = own }))
+	return nil
+}
+
+// zoneLabel makes up a column label for a zone: its abbreviation when it has a
+// proper one, otherwise its city
+func zoneLabel(l *time.Location) string {
+	abbr := time.Now().In(l).Format("MST")
+	if regexp.MustCompile(`^[A-Z]+$`).MatchString(abbr) {
+		return abbr
+	}
+	name := l.String()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.Replace(name, "_", " ", -1)
+}
+
+var timeZoneFlags = []Flag{
+	Flag{Name: "me", Description: "change your own list instead of the channel's", Bool: true},
+	Flag{Name: "24h", Description: "show the zone with a 24-hour clock", Bool: true},
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeExpr is a time, or range of times, mentioned in a message
+type TimeExpr struct {
+	Text  string    // the words it was read from, e.g. "Tuesday at 3pm PT"
+	Start time.Time // in the zone it was given in
+	End   time.Time // zero unless it's a range like "9-11am ET"
+	Zone  string    // the zone as written, "" for relative times like "in 3 hours"
+	Err   error     // set when it looked like a time but didn't make sense
+}
+
+// TimeError says why a time didn't make sense. Key names the message in the
+// catalog that says so in the reader's language, and gets Value.
+type TimeError struct {
+	Key   string
+	Value string
+	text  string // for the logs
+}
+
+func (e *TimeError) Error() string {
+	return e.text
+}
+
+func timeError(key, value, text string) *TimeError {
+	return &TimeError{Key: key, Value: value, text: text}
+}
+
+const (
+	weekdayWords = `monday|mon|tuesday|tues|tue|wednesday|weds|wed|thursday|thurs|thur|thu|friday|fri|saturday|sat|sunday|sun`
+	monthWords   = `january|jan|february|feb|march|mar|april|apr|may|june|jun|july|jul|august|aug|september|sept|sep|october|oct|november|nov|december|dec`
+	dateWords    = `today|tonight|tomorrow|tmrw|yesterday` +
+		`|(?:(?:next|this)\s+)?(?:` + weekdayWords + `)` +
+		`|\d{4}-\d{1,2}-\d{1,2}` +
+		`|(?:` + monthWords + `)\.?\s+\d{1,2}(?:st|nd|rd|th)?(?:,?\s+\d{4})?` +
+		`|\d{1,2}(?:st|nd|rd|th)?\s+(?:` + monthWords + `)\.?(?:,?\s+\d{4})?`
+	meridiem = `([ap]\.?(?:m\.?)?)`
+)
+
+var (
+	// a clock time or range followed by a zone, e.g. "9 AM EST", "15:00 Europe/Berlin", "9-11am ET", "1 GMT+2"
+	clockTimeRe = regexp.MustCompile(`(?i)\b(\d{1,2})(?::(\d{2}))?\s*` + meridiem + `?` +
+		`(?:\s*(?:-|–|to|until)\s*(\d{1,2})(?::(\d{2}))?\s*` + meridiem + `?)?` +
+		`\s+([A-Za-z][A-Za-z_]+(?:/[A-Za-z_]+)*)(?:([+-])(\d{1,2}))?\b`)
+	// a date right before a clock time ("Tuesday at ", "2026-11-03 ") or right after one (" on Tuesday", " tomorrow")
+	dateBeforeRe = regexp.MustCompile(`(?i)(?:^|[^\w-])(` + dateWords + `)\s*,?\s+(?:at\s+|@\s*)?$`)
+	dateAfterRe  = regexp.MustCompile(`(?i)^\s*,?\s+(?:on\s+)?(` + dateWords + `)\b`)
+	// "in 3 hours", "in an hour and 30 minutes"
+	relativeTimeRe = regexp.MustCompile(`(?i)\bin\s+(\d+|an?|one|two|three|four|five|six|seven|eight|nine|ten|half an?)\s+(minutes?|mins?|hours?|hrs?|days?|weeks?)(?:\s+and\s+(\d+)\s+(minutes?|mins?))?\b`)
+
+	// what a zone we don't know has to look like to be worth complaining about,
+	// e.g. "XST" or "Mars/Olympus", so "3pm today" or "3pm works" aren't times
+	zoneLikeRe = regexp.MustCompile(`^(?:[A-Z]{2,5}|[A-Za-z_]+(?:/[A-Za-z_]+)+)$`)
+
+	isoDateRe       = regexp.MustCompile(`^(\d{4})-(\d{1,2})-(\d{1,2})$`)
+	monthDayRe      = regexp.MustCompile(`(?i)^(` + monthWords + `)\.?\s+(\d{1,2})(?:st|nd|rd|th)?(?:,?\s+(\d{4}))?$`)
+	dayMonthRe      = regexp.MustCompile(`(?i)^(\d{1,2})(?:st|nd|rd|th)?\s+(` + monthWords + `)\.?(?:,?\s+(\d{4}))?$`)
+	weekdayPhrase   = regexp.MustCompile(`(?i)^(?:(next|this)\s+)?(` + weekdayWords + `)$`)
+	numberWords     = map[string]int{"a": 1, "an": 1, "one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6, "seven": 7, "eight": 8, "nine": 9, "ten": 10}
+	weekdayPrefixes = map[string]time.Weekday{"mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday, "sun": time.Sunday}
+	monthPrefixes   = map[string]time.Month{"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April, "may": time.May, "jun": time.June,
+		"jul": time.July, "aug": time.August, "sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December}
+)
+
+// ParseTimes finds the times mentioned in text. Clock times need a zone ("3pm
+// PT"), which resolve turns into a location, and can have a date before or after
+// them ("tomorrow 14:00 CET", "9am ET on Friday"). Dates are worked out in the
+// zone the time was given in, so "Tuesday 3pm PT" is the right instant even
+// across a DST change. Relative times ("in 3 hours") count from now.
+func ParseTimes(text string, now time.Time, resolve func(string) (*time.Location, error)) []TimeExpr {
+	type span struct{ start, end int }
+	var taken []span
+	overlaps := func(start, end int) bool {
+		for _, s := range taken {
+			if start < s.end && s.start < end {
+				return true
+			}
+		}
+		return false
+	}
+
+	var found []TimeExpr
+	var at []int
+	add := func(pos int, e TimeExpr) {
+		found = append(found, e)
+		at = append(at, pos)
+	}
+
+	for _, m := range relativeTimeRe.FindAllStringSubmatchIndex(text, -1) {
+		d := relativeDuration(text[m[2]:m[3]], text[m[4]:m[5]])
+		if m[6] >= 0 {
+			n, _ := strconv.Atoi(text[m[6]:m[7]])
+			d += time.Duration(n) * time.Minute
+		}
+		taken = append(taken, span{m[0], m[1]})
+		add(m[0], TimeExpr{Text: text[m[0]:m[1]], Start: now.Add(d).Truncate(time.Minute)})
+	}
+
+	for _, m := range clockTimeRe.FindAllStringSubmatchIndex(text, -1) {
+		if overlaps(m[0], m[1]) {
+			continue
+		}
+		group := func(i int) string {
+			if m[2*i] < 0 {
+				return ""
+			}
+			return text[m[2*i]:m[2*i+1]]
+		}
+		start, end := m[0], m[1]
+		date := ""
+		if d := dateBeforeRe.FindStringSubmatchIndex(text[:start]); d != nil {
+			date, start = text[d[2]:d[3]], d[2]
+		} else if d := dateAfterRe.FindStringSubmatchIndex(text[end:]); d != nil {
+			date, end = text[end+d[2]:end+d[3]], end+d[1]
+		}
+		// without minutes, am/pm or a date, "5 people" is just words
+		looksLikeTime := group(2) != "" || group(3) != "" || group(6) != "" || date != "" || group(4) != ""
+
+		e := TimeExpr{Text: text[start:end], Zone: group(7)}
+		l, err := parseZone(group(7), group(8), group(9), resolve)
+		if err != nil {
+			if !looksLikeTime || group(8) == "" && !zoneLikeRe.MatchString(group(7)) {
+				continue
+			}
+			e.Err = err
+		} else {
+			e.Start, e.End, e.Err = clockTimes(group(1), group(2), group(3), group(4), group(5), group(6), date, now.In(l))
+		}
+		add(start, e)
+	}
+
+	// keep them in the order they were written
+	for i := range found {
+		for j := i; j > 0 && at[j] < at[j-1]; j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+			at[j], at[j-1] = at[j-1], at[j]
+		}
+	}
+	return found
+}
+
+func relativeDuration(amount, unit string) time.Duration {
+	amount = strings.ToLower(amount)
+	var d time.Duration
+	switch unit = strings.ToLower(unit); {
+	case strings.HasPrefix(unit, "min"):
+		d = time.Minute
+	case strings.HasPrefix(unit, "h"):
+		d = time.Hour
+	case strings.HasPrefix(unit, "d"):
+		d = 24 * time.Hour
+	case strings.HasPrefix(unit, "w"):
+		d = 7 * 24 * time.Hour
+	}
+	if strings.HasPrefix(amount, "half") {
+		return d / 2
+	}
+	if n, ok := numberWords[amount]; ok {
+		return time.Duration(n) * d
+	}
+	n, _ := strconv.Atoi(amount)
+	return time.Duration(n) * d
+}
+
+// parseZone resolves a zone name, with an optional offset for GMT/UTC ("GMT+2")
+func parseZone(name, sign, offset string, resolve func(string) (*time.Location, error)) (*time.Location, error) {
+	if sign == "" {
+		return resolve(name)
+	}
+	switch strings.ToUpper(name) {
+	case "GMT", "UTC":
+		// the Etc zones have their signs the other way around
+		if sign == "+" {
+			return time.LoadLocation("Etc/GMT-" + offset)
+		}
+		return time.LoadLocation("Etc/GMT+" + offset)
+	}
+	return nil, timeError("time-offset", name, "I can only add an offset to GMT or UTC, not "+name)
+}
+
+// clockTimes puts a clock time (or range) on the right date in now's location
+func clockTimes(hour, min, mer, endHour, endMin, endMer, date string, now time.Time) (start, end time.Time, err error) {
+	y, mo, d, err := parseDate(date, now)
+	if err != nil {
+		return
+	}
+	// "9-11am" means both are am, "11-1pm" means 11am to 1pm
+	startMer := mer
+	if startMer == "" && endHour != "" {
+		startMer = endMer
+	}
+	h, m, err := clock(hour, min, startMer)
+	if err != nil {
+		return
+	}
+	start = time.Date(y, mo, d, h, m, 0, 0, now.Location())
+	if endHour == "" {
+		return
+	}
+	eh, em, err := clock(endHour, endMin, endMer)
+	if err != nil {
+		return
+	}
+	end = time.Date(y, mo, d, eh, em, 0, 0, now.Location())
+	if mer == "" && endMer != "" && start.After(end) {
+		start = start.Add(-12 * time.Hour)
+	}
+	if !end.After(start) {
+		// "10pm-2am" ends the next day
+		end = time.Date(y, mo, d+1, eh, em, 0, 0, now.Location())
+	}
+	return
+}
+
+func clock(hour, min, mer string) (h, m int, err error) {
+	h, _ = strconv.Atoi(hour)
+	if min != "" {
+		m, _ = strconv.Atoi(min)
+	}
+	if m > 59 {
+		return 0, 0, timeError("time-minutes", min, "minutes go up to 59")
+	}
+	if mer == "" {
+		if h > 23 {
+			return 0, 0, timeError("time-hours-24", hour, "hours go up to 23")
+		}
+		return
+	}
+	if h < 1 || h > 12 {
+		return 0, 0, timeError("time-hours-12", hour, "hours go from 1 to 12 with am or pm")
+	}
+	h %= 12
+	if strings.HasPrefix(strings.ToLower(mer), "p") {
+		h += 12
+	}
+	return
+}
+
+// parseDate works out the day a date phrase means, counting from now. No phrase means today.
+func parseDate(date string, now time.Time) (y int, mo time.Month, d int, err error) {
+	y, mo, d = now.Date()
+	lower := strings.ToLower(date)
+	switch lower {
+	case "", "today", "tonight":
+		return
+	case "tomorrow", "tmrw":
+		y, mo, d = now.AddDate(0, 0, 1).Date()
+		return
+	case "yesterday":
+		y, mo, d = now.AddDate(0, 0, -1).Date()
+		return
+	}
+
+	if m := weekdayPhrase.FindStringSubmatch(lower); m != nil {
+		ahead := (int(weekdayPrefixes[m[2][:3]]) - int(now.Weekday()) + 7) % 7
+		if ahead == 0 && m[1] == "next" {
+			ahead = 7
+		}
+		y, mo, d = now.AddDate(0, 0, ahead).Date()
+		return
+	}
+
+	var year, day string
+	var month time.Month
+	if m := isoDateRe.FindStringSubmatch(lower); m != nil {
+		year, day = m[1], m[3]
+		n, _ := strconv.Atoi(m[2])
+		month = time.Month(n)
+	} else if m := monthDayRe.FindStringSubmatch(lower); m != nil {
+		month, day, year = monthPrefixes[m[1][:3]], m[2], m[3]
+	} else if m := dayMonthRe.FindStringSubmatch(lower); m != nil {
+		day, month, year = m[1], monthPrefixes[m[2][:3]], m[3]
+	} else {
+		return 0, 0, 0, timeError("time-unknown-date", date, fmt.Sprintf("I don't know the date %q", date))
+	}
+	d, _ = strconv.Atoi(day)
+	if month < time.January || month > time.December || d < 1 || d > 31 {
+		return 0, 0, 0, timeError("time-not-a-date", date, fmt.Sprintf("%q isn't a date", date))
+	}
+	if year != "" {
+		y, _ = strconv.Atoi(year)
+	} else if time.Date(y, month, d, 23, 59, 0, 0, now.Location()).Before(now) {
+		// "March 3" in November is next March
+		y++
+	}
+	if t := time.Date(y, month, d, 0, 0, 0, 0, now.Location()); t.Month() != month {
+		return 0, 0, 0, timeError("time-not-a-date", date, fmt.Sprintf("%q isn't a date", date))
+	}
+	mo = month
+	return
+}
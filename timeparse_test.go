@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testZone resolves the zones the tests use, like ResolveZone with a few aliases
+func testZone(name string) (*time.Location, error) {
+	aliases := map[string]string{"PT": "America/Los_Angeles", "ET": "America/New_York", "CET": "Europe/Berlin"}
+	if loc, ok := aliases[strings.ToUpper(name)]; ok {
+		name = loc
+	}
+	if name == "UTC" || strings.Contains(name, "/") {
+		if l, err := time.LoadLocation(name); err == nil {
+			return l, nil
+		}
+	}
+	return nil, timeError("time-unknown-zone", name, "unknown zone "+name)
+}
+
+func TestParseTimes(t *testing.T) {
+	// Friday, October 30th 2026; summer time ended in Europe on the 25th and
+	// ends in America on November 1st
+	now := time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC)
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2026, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		text       string
+		start, end time.Time // in UTC
+		err        string    // the TimeError's Key
+	}{
+		// clock times and their dates
+		{"3pm PT", utc(10, 30, 22, 0), time.Time{}, ""},
+		{"Tuesday at 3pm PT", utc(11, 3, 23, 0), time.Time{}, ""},
+		{"this Friday 9am ET", utc(10, 30, 13, 0), time.Time{}, ""},
+		{"next Friday 9am ET", utc(11, 6, 14, 0), time.Time{}, ""},
+		{"9am ET on Monday", utc(11, 2, 14, 0), time.Time{}, ""},
+		{"tomorrow 14:00 CET", utc(10, 31, 13, 0), time.Time{}, ""},
+		{"2026-11-03 14:00 CET", utc(11, 3, 13, 0), time.Time{}, ""},
+		{"March 3 9am ET", time.Date(2027, 3, 3, 14, 0, 0, 0, time.UTC), time.Time{}, ""},
+		{"3rd December 2027 at 10:00 UTC", time.Date(2027, 12, 3, 10, 0, 0, 0, time.UTC), time.Time{}, ""},
+		{"3pm GMT+2", utc(10, 30, 13, 0), time.Time{}, ""},
+
+		// ranges
+		{"9-11am ET", utc(10, 30, 13, 0), utc(10, 30, 15, 0), ""},
+		{"11-1pm ET", utc(10, 30, 15, 0), utc(10, 30, 17, 0), ""},
+		{"10pm-2am PT", utc(10, 31, 5, 0), utc(10, 31, 9, 0), ""},
+		// the clocks go back during this one
+		{"Saturday 10pm to 2am PT", utc(11, 1, 5, 0), utc(11, 1, 10, 0), ""},
+
+		// relative times
+		{"in 3 hours", utc(10, 30, 15, 0), time.Time{}, ""},
+		{"in an hour and 30 minutes", utc(10, 30, 13, 30), time.Time{}, ""},
+		{"in half an hour", utc(10, 30, 12, 30), time.Time{}, ""},
+		{"in two days", utc(11, 1, 12, 0), time.Time{}, ""},
+
+		// times that don't make sense
+		{"Feb 30 10am ET", time.Time{}, time.Time{}, "time-not-a-date"},
+		{"25:00 UTC", time.Time{}, time.Time{}, "time-hours-24"},
+		{"13pm ET", time.Time{}, time.Time{}, "time-hours-12"},
+		{"10:75 ET", time.Time{}, time.Time{}, "time-minutes"},
+		{"3pm XST", time.Time{}, time.Time{}, "time-unknown-zone"},
+		{"3pm PST+2", time.Time{}, time.Time{}, "time-offset"},
+	}
+	for _, tt := range tests {
+		found := ParseTimes(tt.text, now, testZone)
+		if len(found) != 1 {
+			t.Errorf("%q: found %d times, want 1", tt.text, len(found))
+			continue
+		}
+		e := found[0]
+		if tt.err != "" {
+			if te, ok := e.Err.(*TimeError); !ok || te.Key != tt.err {
+				t.Errorf("%q: got the error %v, want %s", tt.text, e.Err, tt.err)
+			}
+			continue
+		}
+		if e.Err != nil || !e.Start.Equal(tt.start) || !e.End.Equal(tt.end) {
+			t.Errorf("%q: got %v to %v (%v), want %v to %v", tt.text, e.Start.UTC(), e.End.UTC(), e.Err, tt.start, tt.end)
+		}
+		if e.Text != tt.text {
+			t.Errorf("%q: read it from %q", tt.text, e.Text)
+		}
+	}
+}
+
+func TestParseTimesIgnoresWords(t *testing.T) {
+	now := time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC)
+	for _, text := range []string{
+		"3pm today",
+		"does 3pm work for you?",
+		"see you at 3pm sharp",
+		"I have 5 cats",
+		"we need 2 volunteers",
+		"version 1.2 is out",
+	} {
+		if found := ParseTimes(text, now, testZone); len(found) != 0 {
+			t.Errorf("%q: found %+v", text, found)
+		}
+	}
+}
+
+func TestParseTimesKeepsTheOrder(t *testing.T) {
+	now := time.Date(2026, 10, 30, 12, 0, 0, 0, time.UTC)
+	found := ParseTimes("in 2 hours, or tomorrow 9am ET, or else 5pm CET", now, testZone)
+	var got []string
+	for _, e := range found {
+		got = append(got, e.Text)
+	}
+	if strings.Join(got, "|") != "in 2 hours|tomorrow 9am ET|5pm CET" {
+		t.Errorf("got %q", got)
+	}
+}
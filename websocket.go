@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// how often we check that the websocket is still alive. If neither an event nor
+	// a reply to our ping shows up within one interval the connection is considered dead.
+	wsPingInterval = 30 * time.Second
+
+	// reconnect backoff bounds
+	wsMinBackoff = time.Second
+	wsMaxBackoff = 2 * time.Minute
+
+	// a connection that lasted at least this long counts as healthy and resets the backoff
+	wsHealthyUptime = time.Minute
+)
+
+// SuperviseWebSocket keeps a websocket connection to the server open for as long
+// as the bot runs. Whenever the connection drops it reconnects with exponential
+// backoff, logging back in first if our session has expired, and then replays
+// any posts made in the moderated channels while we weren't listening.
+func (b *Bot) SuperviseWebSocket(ctx context.Context) {
+	backoff := wsMinBackoff
+	connected := false
+	for {
+		ws, err := b.ConnectWebSocket()
+		if err != nil {
+			println("We failed to connect to the web socket")
+			PrintError(err)
+			if backoff = waitToReconnect(ctx, backoff); ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		b.webSocketClient = ws
+		if connected {
+			b.SendMsgToDebuggingChannel("_Reconnected to the websocket, catching up on missed posts_", "")
+			b.CatchUpMissedPosts(ctx)
+		} else if b.loadLastSeen() {
+			// we were running before, so catch up on whatever was posted while we were down
+			b.CatchUpMissedPosts(ctx)
+		} else {
+			b.noteSeen(b.newestPostTime(ctx), "")
+		}
+		connected = true
+
+		started := time.Now()
+		reason := b.ReadWebSocket(ctx, ws)
+		ws.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Printf("websocket connection lost (%s) after %v\n", reason, time.Since(started))
+
+		if time.Since(started) >= wsHealthyUptime {
+			backoff = wsMinBackoff
+		}
+		if backoff = waitToReconnect(ctx, backoff); ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// waitToReconnect sleeps for the current backoff (or until ctx is done) and
+// returns the next one
+func waitToReconnect(ctx context.Context, backoff time.Duration) time.Duration {
+	fmt.Printf("reconnecting to the websocket in %v\n", backoff)
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+	}
+	backoff *= 2
+	if backoff > wsMaxBackoff {
+		backoff = wsMaxBackoff
+	}
+	return backoff
+}
+
+// ConnectWebSocket opens and starts listening on a new websocket connection,
+// logging in again first if the server no longer accepts our token.
+func (b *Bot) ConnectWebSocket() (ws *model.WebSocketClient, err *model.AppError) {
+	if _, resp := b.client.GetMe(""); resp.Error != nil {
+		if resp.StatusCode != http.StatusUnauthorized {
+			return nil, resp.Error
+		}
+		println("Our session has expired, logging in again")
+		if err = b.Login(); err != nil {
+			return
+		}
+	}
+
+	// ws, err = model.NewWebSocketClient4("ws://"+b.cfg().Domain, b.clientAuthToken()) //FOR TESTING
+	ws, err = model.NewWebSocketClient4("wss://"+b.cfg().Domain, b.clientAuthToken())
+	if err != nil {
+		return
+	}
+	ws.Listen()
+	return
+}
+
+// ReadWebSocket handles events from the connection until it closes or stops
+// answering pings, or ctx is done, and returns why it stopped.
+func (b *Bot) ReadWebSocket(ctx context.Context, ws *model.WebSocketClient) string {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	awaitingPong := false
+	for {
+		select {
+		case <-ctx.Done():
+			return "stopped"
+
+		case event, ok := <-ws.EventChannel:
+			if !ok {
+				if ws.ListenError != nil {
+					return "listen error: " + ws.ListenError.Error()
+				}
+				return "event channel closed"
+			}
+			awaitingPong = false
+			if event.Event == model.WEBSOCKET_EVENT_POSTED {
+				if post := postFromEvent(event); post != nil {
+					if b.wasReplayed(post.Id) {
+						continue
+					}
+					b.noteSeen(post.CreateAt, post.Id)
+				}
+			}
+			b.HandleWebSocketResponse(event)
+
+		case _, ok := <-ws.ResponseChannel:
+			if !ok {
+				return "response channel closed"
+			}
+			awaitingPong = false
+
+		case <-ping.C:
+			if awaitingPong {
+				return "ping timeout"
+			}
+			// any request works as a ping, the server answers on the ResponseChannel
+			ws.GetStatuses()
+			awaitingPong = true
+		}
+	}
+}
+
+func postFromEvent(event *model.WebSocketEvent) *model.Post {
+	data, ok := event.Data["post"].(string)
+	if !ok {
+		return nil
+	}
+	return model.PostFromJson(strings.NewReader(data))
+}
+
+func (b *Bot) noteSeen(at int64, postId string) {
+	b.lastSeen.Lock()
+	defer b.lastSeen.Unlock()
+	if at > b.lastSeen.at {
+		b.lastSeen.at = at
+		b.lastSeen.ids = make(map[string]bool)
+	}
+	if at == b.lastSeen.at && postId != "" {
+		b.lastSeen.ids[postId] = true
+	}
+}
+
+// wasReplayed reports whether the last catch-up already handled a post, and
+// forgets it, since the websocket delivers each post at most once more
+func (b *Bot) wasReplayed(postId string) bool {
+	b.lastSeen.Lock()
+	defer b.lastSeen.Unlock()
+	if !b.lastSeen.replayed[postId] {
+		return false
+	}
+	delete(b.lastSeen.replayed, postId)
+	return true
+}
+
+// newestPostTime returns the CreateAt of the newest post in the moderated
+// channels, which is where a bot that never ran starts reading. It's the
+// server's clock rather than ours, so a skewed clock can't make a catch-up
+// skip or replay posts. It's 0 if there are no posts yet.
+func (b *Bot) newestPostTime(ctx context.Context) (at int64) {
+	for _, channel := range b.ModeratedChannels() {
+		list, resp := b.api(ctx).GetPostsForChannel(channel.Id, 0, 1, "")
+		if resp.Error != nil {
+			fmt.Printf("couldn't get the newest post in %v\n", channel.Name)
+			PrintError(resp.Error)
+			continue
+		}
+		for _, post := range list.Posts {
+			if post.CreateAt > at {
+				at = post.CreateAt
+			}
+		}
+	}
+	return
+}
+
+// loadLastSeen restores where the last run of the bot stopped reading, and
+// reports whether there was anything to restore
+func (b *Bot) loadLastSeen() bool {
+	var at int64
+	found, err := b.store.Get("websocket", "last_seen", &at)
+	if err != nil {
+		fmt.Printf("couldn't load the last seen post time: %v\n", err)
+	}
+	if !found || err != nil {
+		return false
+	}
+	b.noteSeen(at, "")
+	return true
+}
+
+// saveLastSeen persists the time of the newest post seen so a restarted bot can catch up
+func (b *Bot) saveLastSeen() {
+	b.lastSeen.Lock()
+	at := b.lastSeen.at
+	b.lastSeen.Unlock()
+	if at == 0 {
+		return
+	}
+	if err := b.store.Put("websocket", "last_seen", at); err != nil {
+		fmt.Printf("couldn't save the last seen post time: %v\n", err)
+	}
+}
+
+// ModeratedChannels returns the channels whose posts must never go unchecked
+func (b *Bot) ModeratedChannels() []*model.Channel {
+	b.lk.RLock()
+	defer b.lk.RUnlock()
+	return b.moderatedChannels
+}
+
+// CatchUpMissedPosts feeds every post created in a moderated channel since the
+// last one we saw through the handlers as if it had arrived over the websocket,
+// oldest first across all the channels
+func (b *Bot) CatchUpMissedPosts(ctx context.Context) {
+	// replaying moves lastSeen on, so what counts as seen is decided up front
+	b.lastSeen.Lock()
+	since := b.lastSeen.at
+	seen := make(map[string]bool)
+	for id := range b.lastSeen.ids {
+		seen[id] = true
+	}
+	b.lastSeen.replayed = make(map[string]bool)
+	b.lastSeen.Unlock()
+
+	type missedPost struct {
+		channel *model.Channel
+		post    *model.Post
+	}
+	var missed []missedPost
+	for _, channel := range b.ModeratedChannels() {
+		list, resp := b.api(ctx).GetPostsSince(channel.Id, since)
+		if resp.Error != nil {
+			fmt.Printf("We failed to get the missed posts in %v\n", channel.Name)
+			PrintError(resp.Error)
+			continue
+		}
+		n := 0
+		for _, post := range list.Posts {
+			// GetPostsSince also returns older posts that were edited or deleted since
+			if post.DeleteAt == 0 && (post.CreateAt > since || post.CreateAt == since && !seen[post.Id]) {
+				missed = append(missed, missedPost{channel, post})
+				n++
+			}
+		}
+		if n > 0 {
+			b.SendMsgToDebuggingChannel(fmt.Sprintf("_Replaying %d post(s) missed in ~%v_", n, channel.Name), "")
+		}
+	}
+	sort.SliceStable(missed, func(i, j int) bool { return missed[i].post.CreateAt < missed[j].post.CreateAt })
+	for _, m := range missed {
+		if ctx.Err() != nil {
+			return
+		}
+		b.lastSeen.Lock()
+		b.lastSeen.replayed[m.post.Id] = true
+		b.lastSeen.Unlock()
+		b.HandleWebSocketResponse(b.MissedPostEvent(ctx, m.channel, m.post))
+		b.noteSeen(m.post.CreateAt, m.post.Id)
+	}
+}
+
+// MissedPostEvent rebuilds the "posted" event the server would have sent us
+func (b *Bot) MissedPostEvent(ctx context.Context, channel *model.Channel, post *model.Post) *model.WebSocketEvent {
+	event := model.NewWebSocketEvent(model.WEBSOCKET_EVENT_POSTED, channel.TeamId, channel.Id, "", nil)
+	event.Data["post"] = post.ToJson()
+	event.Data["channel_name"] = channel.Name
+	event.Data["channel_type"] = channel.Type
+	event.Data["sender_name"] = ""
+	if user, resp := b.api(ctx).GetUser(post.UserId, ""); resp.Error == nil {
+		event.Data["sender_name"] = user.Username
+	}
+	return event
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"testing"
+)
+
+// recordPosts replaces the bot's actions with one that records the posts it's given
+func (tb *testBot) recordPosts() *[]string {
+	var seen []string
+	tb.actions = []Action{{Name: "record", Event: model.WEBSOCKET_EVENT_POSTED, Handler: func(ctx context.Context, event *model.WebSocketEvent) error {
+		seen = append(seen, postFromEvent(event).Message)
+		return nil
+	}}}
+	return &seen
+}
+
+func TestCatchUpMissedPostsOnlyOnce(t *testing.T) {
+	tb := newTestBot(t)
+	seen := tb.recordPosts()
+	tb.noteSeen(1, "")
+	missed := tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.announcements.Id, Message: "missed"})
+	tb.CatchUpMissedPosts(context.Background())
+
+	// the websocket was listening during the catch-up, so it has the post too
+	ws := &model.WebSocketClient{EventChannel: make(chan *model.WebSocketEvent, 2), ResponseChannel: make(chan *model.WebSocketResponse)}
+	ws.EventChannel <- tb.s.PostedEvent(missed)
+	ws.EventChannel <- tb.post(tb.alice, tb.announcements, "new")
+	close(ws.EventChannel)
+	if reason := tb.ReadWebSocket(context.Background(), ws); reason != "event channel closed" {
+		t.Fatalf("stopped reading because of %s", reason)
+	}
+	if got := strings.Join(*seen, ","); got != "missed,new" {
+		t.Errorf("handled %s, want missed,new", got)
+	}
+}
+
+func TestNewestPostTime(t *testing.T) {
+	tb := newTestBot(t)
+	if at := tb.newestPostTime(context.Background()); at != 0 {
+		t.Errorf("got %d without any posts, want 0", at)
+	}
+	for _, at := range []int64{1000, 3000, 2000} {
+		tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.announcements.Id, Message: "hi", CreateAt: at})
+	}
+	// posts in channels that aren't moderated don't count
+	tb.s.AddPost(&model.Post{UserId: tb.alice.Id, ChannelId: tb.town.Id, Message: "hi", CreateAt: 5000})
+	if at := tb.newestPostTime(context.Background()); at != 3000 {
+		t.Errorf("got %d, want the newest post's 3000", at)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/mattermost/mattermost-server/model"
+	"strings"
+	"time"
+)
+
+const (
+	// who has been welcomed to which team, by "<team id>:<user id>"
+	welcomesNamespace = "welcomes"
+	// people who signed up but haven't joined a team yet, by user id
+	pendingWelcomesNamespace = "pending-welcomes"
+
+	// how long we wait for someone who signed up to join a team
+	pendingWelcomeExpiry = 24 * time.Hour
+)
+
+// TeamWelcome is what happens when someone joins a team
+type TeamWelcome struct {
+	Team            string   // the team's name
+	Channels        []string // channels on the team they're added to, e.g. ["announcements"]
+	Onboarding      bool     // whether they get the Onboarding DMs
+	Message         string   // a message in the catalog to DM them, "" for none
+	ExceptMembersOf []string // teams whose members are left alone, e.g. staff joining the public team
+}
+
+// Welcome records that someone was welcomed to a team, so it only happens once
+type Welcome struct {
+	At      int64  // millis
+	Skipped string `json:",omitempty"` // why nothing was done, e.g. they're in an ExceptMembersOf team
+}
+
+// PendingWelcome is someone who signed up and will be welcomed once they join a team
+type PendingWelcome struct {
+	UserId string
+	Since  int64 // millis
+}
+
+// teamWelcomes returns the configured welcomes, or the one we have by default:
+// new members of the public team who aren't on the private team are added to
+// ~announcements and onboarded
+func (cfg *Config) teamWelcomes() []TeamWelcome {
+	if len(cfg.TeamWelcomes) > 0 {
+		return cfg.TeamWelcomes
+	}
+	return []TeamWelcome{{Team: cfg.PublicTeamName, Channels: []string{"announcements"}, Onboarding: true,
+		ExceptMembersOf: []string{cfg.PrivateTeamName}}}
+}
+
+// teamWelcome returns the welcome for a team, nil if it hasn't got one
+func (cfg *Config) teamWelcome(teamName string) *TeamWelcome {
+	welcomes := cfg.teamWelcomes()
+	for i := range welcomes {
+		if welcomes[i].Team == teamName {
+			return &welcomes[i]
+		}
+	}
+	return nil
+}
+
+// validateTeamWelcomes returns what's wrong with the welcomes, if anything
+func validateTeamWelcomes(welcomes []TeamWelcome) (problems []string) {
+	seen := make(map[string]bool)
+	for _, w := range welcomes {
+		if w.Team == "" {
+			problems = append(problems, "has a welcome without a Team")
+			continue
+		}
+		if seen[w.Team] {
+			problems = append(problems, fmt.Sprintf("has two welcomes for %q", w.Team))
+		}
+		seen[w.Team] = true
+	}
+	return
+}
+
+// HandleTeamJoins welcomes people to the teams they join. Mattermost tells the
+// members of a team's town square when someone is added to it, which happens
+// when they join the team, and tells people themselves when they're added to a
+// team. People who just signed up are remembered until they join one.
+func (b *Bot) HandleTeamJoins(ctx context.Context, event *model.WebSocketEvent) (err error) {
+	userId, _ := event.Data["user_id"].(string)
+	if userId == "" || userId == b.botUser.Id {
+		return
+	}
+	switch event.Event {
+	case model.WEBSOCKET_EVENT_NEW_USER:
+		return b.store.Put(pendingWelcomesNamespace, userId, PendingWelcome{UserId: userId, Since: model.GetMillis()})
+	case model.WEBSOCKET_EVENT_USER_ADDED:
+		// being added to any other channel isn't joining the team
+		if event.Broadcast == nil {
+			return
+		}
+		if channel, resp := b.api(ctx).GetChannel(event.Broadcast.ChannelId, ""); resp.Error != nil || channel.Name != model.DEFAULT_CHANNEL {
+			return
+		}
+	}
+	teamId, _ := event.Data["team_id"].(string)
+	team, resp := b.api(ctx).GetTeam(teamId, "")
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if err = b.WelcomeToTeam(ctx, userId, team); err == nil {
+		b.store.Delete(pendingWelcomesNamespace, userId)
+	}
+	return
+}
+
+// WelcomeToTeam does what the team's welcome says for someone who joined it,
+// unless they were welcomed to it before. They're marked as welcomed first, so
+// a restart or a second event never welcomes them twice.
+func (b *Bot) WelcomeToTeam(ctx context.Context, userId string, team *model.Team) error {
+	w := b.cfg().teamWelcome(team.Name)
+	if w == nil {
+		return nil
+	}
+	b.welcoming.Lock()
+	key := team.Id + ":" + userId
+	found, err := b.store.Get(welcomesNamespace, key, &Welcome{})
+	welcome := Welcome{At: model.GetMillis()}
+	if !found && err == nil {
+		welcome.Skipped = b.welcomeSkipped(ctx, userId, w)
+		err = b.store.Put(welcomesNamespace, key, welcome)
+	}
+	b.welcoming.Unlock()
+	if found || err != nil {
+		return err
+	}
+	if welcome.Skipped != "" {
+		if b.cfg().Debugging {
+			fmt.Printf("not welcoming %s to %s: %s\n", userId, team.Name, welcome.Skipped)
+		}
+		return nil
+	}
+	b.SendMsgToDebuggingChannel(fmt.Sprintf("Welcoming a new member of %s", team.Name), "")
+
+	for _, name := range w.Channels {
+		channel := b.FindChannel(ctx, strings.TrimPrefix(name, "~"), team)
+		if channel == nil {
+			continue
+		}
+		_, resp := b.api(ctx).AddChannelMember(channel.Id, userId)
+		b.Audit(AuditEntry{Action: AuditAddMember, UserId: userId, ChannelId: channel.Id, Channel: channel.Name,
+			Detail: "new to " + team.Name, Outcome: outcome(resp.Error)})
+	}
+	if w.Message != "" {
+		data := b.messageData(ctx, userId)
+		data.Team = team.Name
+		msg, err := b.RenderMessage(w.Message, data)
+		if err == nil {
+			err = b.SendDirectMessage(ctx, userId, msg)
+		}
+		b.Audit(AuditEntry{Action: AuditSendDM, UserId: userId, Detail: "welcome to " + team.Name + ": " + w.Message, Outcome: outcome(err)})
+	}
+	if w.Onboarding {
+		// welcome them, and keep in touch over their first days
+		if err := b.StartOnboarding(ctx, userId); err != nil {
+			fmt.Printf("couldn't onboard %s: %v\n", userId, err)
+		}
+	}
+	return nil
+}
+
+// welcomeSkipped returns why someone shouldn't be welcomed, "" if they should
+func (b *Bot) welcomeSkipped(ctx context.Context, userId string, w *TeamWelcome) string {
+	if len(w.ExceptMembersOf) == 0 {
+		return ""
+	}
+	teams, resp := b.api(ctx).GetTeamsForUser(userId, "")
+	if resp.Error != nil {
+		return ""
+	}
+	for _, t := range teams {
+		for _, name := range w.ExceptMembersOf {
+			if t.Name == name {
+				return "member of " + name
+			}
+		}
+	}
+	return ""
+}
+
+// WelcomePending welcomes the people who signed up to the teams they've joined
+// since, and forgets the ones who didn't join any for too long
+func (b *Bot) WelcomePending(ctx context.Context) {
+	keys, err := b.store.Keys(pendingWelcomesNamespace)
+	if err != nil {
+		fmt.Printf("couldn't read the pending welcomes: %v\n", err)
+		return
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		var p PendingWelcome
+		if _, err = b.store.Get(pendingWelcomesNamespace, key, &p); err != nil {
+			continue
+		}
+		teams, resp := b.api(ctx).GetTeamsForUser(p.UserId, "")
+		if resp.Error != nil {
+			continue
+		}
+		if len(teams) == 0 {
+			if time.Duration(model.GetMillis()-p.Since)*time.Millisecond > pendingWelcomeExpiry {
+				b.store.Delete(pendingWelcomesNamespace, key)
+			}
+			continue
+		}
+		welcomed := true
+		for _, team := range teams {
+			if err = b.WelcomeToTeam(ctx, p.UserId, team); err != nil {
+				fmt.Printf("couldn't welcome %s to %s: %v\n", p.UserId, team.Name, err)
+				welcomed = false
+			}
+		}
+		if welcomed {
+			b.store.Delete(pendingWelcomesNamespace, key)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"github.com/mattermost/mattermost-server/model"
+	"testing"
+)
+
+func TestHandleTeamJoins(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    func(tb *testBot, user *model.User) *model.WebSocketEvent
+		welcomed bool
+	}{
+		{"added to town square", func(tb *testBot, user *model.User) *model.WebSocketEvent {
+			return tb.s.UserAddedEvent(tb.town, user.Id)
+		}, true},
+		{"added to the team", func(tb *testBot, user *model.User) *model.WebSocketEvent {
+			return tb.s.AddedToTeamEvent(tb.team, user.Id)
+		}, true},
+		{"added to another channel", func(tb *testBot, user *model.User) *model.WebSocketEvent {
+			return tb.s.UserAddedEvent(tb.s.AddChannel("random", tb.team), user.Id)
+		}, false},
+		{"signed up", func(tb *testBot, user *model.User) *model.WebSocketEvent {
+			return tb.s.NewUserEvent(user.Id)
+		}, false},
+	}
+	for _, tt := range tests {
+		tb := newTestBot(t)
+		bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+		tb.s.JoinTeam(bob.Id, tb.team)
+		if err := tb.HandleTeamJoins(context.Background(), tt.event(tb, bob)); err != nil {
+			t.Fatal(err)
+		}
+		if welcomed := tb.s.IsChannelMember(tb.announcements.Id, bob.Id); welcomed != tt.welcomed {
+			t.Errorf("%s: added to ~announcements %v, want %v", tt.name, welcomed, tt.welcomed)
+		}
+		if got := tb.sentTo(tb.dm(bob), 0); tt.welcomed != (len(got) > 0) {
+			t.Errorf("%s: got the DMs %q", tt.name, got)
+		}
+	}
+}
+
+func TestWelcomeOnlyOnce(t *testing.T) {
+	tb := newTestBot(t)
+	bob := tb.s.AddUser("bob", "bob@example.com", "secret")
+	tb.s.JoinTeam(bob.Id, tb.team)
+	tb.HandleTeamJoins(context.Background(), tb.s.UserAddedEvent(tb.town, bob.Id))
+	n := len(tb.s.Created)
+	tb.HandleTeamJoins(context.Background(), tb.s.AddedToTeamEvent(tb.team, bob.Id))
+	if len(tb.s.Created) != n {
+		t.Errorf("welcomed bob twice")
+	}
+}
+
+func TestWelcomeLeavesStaffAlone(t *testing.T) {
+	tb := newTestBot(t)
+	tb.config.PrivateTeamName = "staff"
+	carol := tb.s.AddUser("carol", "carol@example.com", "secret")
+	tb.s.JoinTeam(carol.Id, tb.s.AddTeam("staff"))
+	tb.s.JoinTeam(carol.Id, tb.team)
+	tb.HandleTeamJoins(context.Background(), tb.s.UserAddedEvent(tb.town, carol.Id))
+	if tb.s.IsChannelMember(tb.announcements.Id, carol.Id) || len(tb.s.Created) != 0 {
+		t.Errorf("welcomed carol, who is on the staff team")
+	}
+}
+
+func TestWelcomePending(t *testing.T) {
+	tb := newTestBot(t)
+	dave := tb.s.AddUser("dave", "dave@example.com", "secret")
+	if err := tb.HandleTeamJoins(context.Background(), tb.s.NewUserEvent(dave.Id)); err != nil {
+		t.Fatal(err)
+	}
+	tb.WelcomePending(context.Background())
+	if keys, _ := tb.store.Keys(pendingWelcomesNamespace); len(keys) != 1 {
+		t.Fatalf("got the pending welcomes %v before dave joined a team", keys)
+	}
+
+	tb.s.JoinTeam(dave.Id, tb.team)
+	tb.WelcomePending(context.Background())
+	if !tb.s.IsChannelMember(tb.announcements.Id, dave.Id) {
+		t.Errorf("dave wasn't welcomed after joining the team")
+	}
+	if keys, _ := tb.store.Keys(pendingWelcomesNamespace); len(keys) != 0 {
+		t.Errorf("got the pending welcomes %v after dave was welcomed", keys)
+	}
+}